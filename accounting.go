@@ -0,0 +1,322 @@
+package stcp
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/taodev/stcp/key"
+)
+
+// ErrQuotaExceeded 表示客户端公钥的流量配额已用尽
+var ErrQuotaExceeded = errors.New("stcp: quota exceeded")
+
+// 统计周期的格式, 按自然月 (UTC) 统计
+const usagePeriodLayout = "2006-01"
+
+type AccountingConfig struct {
+	// 按客户端公钥统计的流量写入的文件, JSON 格式, 重启时读取, 为空时只在内存中统计
+	AccountingPath string `yaml:"accounting_path"`
+	// 写入统计文件的间隔
+	AccountingInterval time.Duration `yaml:"accounting_interval" default:"1m"`
+	// 定期写入和关闭时写入统计文件失败时调用
+	OnAccountingError func(err error) `yaml:"-"`
+}
+
+// Usage 客户端公钥在一个统计周期内的流量, 按底层连接的字节数统计
+type Usage struct {
+	// 统计周期, 格式为 2006-01
+	Period string `json:"period"`
+	// 服务端读取的字节数
+	Read int64 `json:"read"`
+	// 服务端写入的字节数
+	Write int64 `json:"write"`
+}
+
+// keyUsage 单个客户端公钥的流量, 所有连接共享
+type keyUsage struct {
+	a *accounting
+
+	read  atomic.Int64
+	write atomic.Int64
+	quota atomic.Int64
+	// 配额用尽后的限速, 未用尽时不限速
+	throttle  *limiterPair
+	exhausted atomic.Bool
+
+	// 以下字段由 a.mu 保护
+	period    string
+	throttleN int
+	conns     map[*Conn]struct{}
+}
+
+func (u *keyUsage) add(n int, write bool) {
+	if n <= 0 {
+		return
+	}
+	if write {
+		u.write.Add(int64(n))
+	} else {
+		u.read.Add(int64(n))
+	}
+	if q := u.quota.Load(); q > 0 && !u.exhausted.Load() && u.read.Load()+u.write.Load() >= q {
+		u.a.exhaust(u)
+	}
+}
+
+// accounting 按客户端公钥统计流量
+type accounting struct {
+	mu      sync.Mutex
+	usage   map[string]*keyUsage
+	loadErr error
+	once    sync.Once
+	started chan struct{}
+}
+
+// startAccounting 首次使用时读取统计文件并开始定期写入
+func (ctx *ServerContext) startAccounting() error {
+	a := &ctx.acct
+	a.once.Do(func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.usage = make(map[string]*keyUsage)
+		a.loadErr = a.load(ctx.AccountingPath)
+		close(a.started)
+	})
+	return a.loadErr
+}
+
+// load 读取统计文件, 调用方需持有 a.mu
+func (a *accounting) load(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved map[string]Usage
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	// 过去周期的流量已经清零, 不再读取
+	now := usagePeriod(time.Now())
+	for fp, s := range saved {
+		if s.Period != now {
+			continue
+		}
+		u := a.newUsage(s.Period)
+		u.read.Store(s.Read)
+		u.write.Store(s.Write)
+		a.usage[fp] = u
+	}
+	return nil
+}
+
+// newUsage 调用方需持有 a.mu
+func (a *accounting) newUsage(period string) *keyUsage {
+	return &keyUsage{
+		a:        a,
+		throttle: newLimiterPair(Limits{}),
+		period:   period,
+		conns:    make(map[*Conn]struct{}),
+	}
+}
+
+// accounted 是否统计该公钥的流量, 只统计 AuthorizedKeys 中和设置了 KeyPolicy 的公钥,
+// 避免每次生成新密钥的客户端让统计无限增长
+func (ctx *ServerContext) accounted(fp string) bool {
+	if _, ok := ctx.KeyPolicies[fp]; ok {
+		return true
+	}
+	for _, k := range ctx.AuthorizedKeys {
+		if key.Fingerprint(k) == fp {
+			return true
+		}
+	}
+	return false
+}
+
+// acquireUsage 登记连接, 返回客户端公钥的流量统计, 连接关闭时需要调用 release
+// 不统计的公钥返回不登记的 keyUsage; 配额已用尽且不限速时返回 ErrQuotaExceeded
+func (ctx *ServerContext) acquireUsage(c *Conn) (u *keyUsage, release func(), err error) {
+	if err = ctx.startAccounting(); err != nil {
+		return nil, nil, err
+	}
+	a := &ctx.acct
+	fp := key.Fingerprint(c.peerKey)
+	if !ctx.accounted(fp) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.newUsage(usagePeriod(time.Now())), func() {}, nil
+	}
+	policy := ctx.keyPolicy(c.peerKey)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u = a.usage[fp]
+	if u == nil {
+		u = a.newUsage(usagePeriod(time.Now()))
+		a.usage[fp] = u
+	}
+	a.rollover(u, usagePeriod(time.Now()))
+	u.quota.Store(policy.MonthlyQuota)
+	u.throttleN = policy.QuotaThrottle
+	if policy.MonthlyQuota > 0 && u.read.Load()+u.write.Load() >= policy.MonthlyQuota {
+		u.exhausted.Store(true)
+	}
+	if u.exhausted.Load() {
+		if u.throttleN <= 0 {
+			return nil, nil, ErrQuotaExceeded
+		}
+		u.throttle.set(Limits{Read: u.throttleN, Write: u.throttleN})
+	}
+
+	u.conns[c] = struct{}{}
+	release = func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(u.conns, c)
+	}
+	return u, release, nil
+}
+
+// exhaust 配额用尽后限速, 不限速时断开该公钥的所有连接
+func (a *accounting) exhaust(u *keyUsage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !u.exhausted.CompareAndSwap(false, true) {
+		return
+	}
+	if u.throttleN > 0 {
+		u.throttle.set(Limits{Read: u.throttleN, Write: u.throttleN})
+		return
+	}
+	for c := range u.conns {
+		c.abort(ErrQuotaExceeded)
+	}
+}
+
+// rollover 进入新的统计周期时清零流量并解除限制, 调用方需持有 a.mu
+func (a *accounting) rollover(u *keyUsage, period string) {
+	if u.period == period {
+		return
+	}
+	u.period = period
+	u.read.Store(0)
+	u.write.Store(0)
+	u.exhausted.Store(false)
+	u.throttle.set(Limits{})
+}
+
+func usagePeriod(t time.Time) string {
+	return t.UTC().Format(usagePeriodLayout)
+}
+
+// Usage 返回各客户端公钥本周期的流量, 键为公钥指纹
+func (ctx *ServerContext) Usage() map[string]Usage {
+	a := &ctx.acct
+	if ctx.startAccounting() != nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.snapshot()
+}
+
+// snapshot 调用方需持有 a.mu
+func (a *accounting) snapshot() map[string]Usage {
+	out := make(map[string]Usage, len(a.usage))
+	for fp, u := range a.usage {
+		out[fp] = Usage{Period: u.period, Read: u.read.Load(), Write: u.write.Load()}
+	}
+	return out
+}
+
+// FlushUsage 检查统计周期, 并立即将流量统计写入 AccountingPath
+func (ctx *ServerContext) FlushUsage() error {
+	if err := ctx.startAccounting(); err != nil {
+		return err
+	}
+	a := &ctx.acct
+	a.mu.Lock()
+	now := usagePeriod(time.Now())
+	for fp, u := range a.usage {
+		// 过去周期且没有连接的公钥不再保留
+		if u.period != now && len(u.conns) == 0 {
+			delete(a.usage, fp)
+			continue
+		}
+		a.rollover(u, now)
+	}
+	usage := a.snapshot()
+	a.mu.Unlock()
+
+	if ctx.AccountingPath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ctx.AccountingPath, data)
+}
+
+// writeFileAtomic 先写入临时文件再重命名, 避免写入中断时损坏原文件
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// accountingLoop 首次使用后定期写入统计文件, 关闭时再写入一次
+func (ctx *ServerContext) accountingLoop() {
+	defer ctx.wait.Done()
+	select {
+	case <-ctx.acct.started:
+	case <-ctx.closeCh:
+		return
+	}
+	interval := ctx.AccountingInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx.flushUsage()
+		case <-ctx.closeCh:
+			ctx.flushUsage()
+			return
+		}
+	}
+}
+
+// flushUsage 后台写入统计文件, 失败时通过 OnAccountingError 报告
+func (ctx *ServerContext) flushUsage() {
+	if err := ctx.FlushUsage(); err != nil {
+		if fn := ctx.OnAccountingError; fn != nil {
+			fn(err)
+		}
+	}
+}
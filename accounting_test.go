@@ -0,0 +1,147 @@
+package stcp
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+
+	"github.com/taodev/stcp/key"
+)
+
+func TestAccounting(t *testing.T) {
+	pub, err := key.PublicKey(testClientKey)
+	require.NoError(t, err)
+	fp := key.Fingerprint(pub)
+
+	data := make([]byte, 8*1024)
+	rand.Read(data)
+
+	t.Run("persist", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "usage.json")
+		clientConfig, serverCtx := newTestConfig(t)
+		serverCtx.AccountingPath = path
+		serverCtx.AuthorizedKeys = [][]byte{pub}
+
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		_, err = client.Write(data)
+		require.NoError(t, err)
+		_, err = io.ReadFull(server, make([]byte, len(data)))
+		require.NoError(t, err)
+		client.Close()
+		server.Close()
+
+		usage := serverCtx.Usage()[fp]
+		assert.Greater(t, usage.Read, int64(len(data)))
+		assert.Equal(t, usagePeriod(time.Now()), usage.Period)
+		// 关闭时写入统计文件
+		serverCtx.Close()
+
+		_, restarted := newTestConfig(t)
+		restarted.AccountingPath = path
+		assert.Equal(t, usage, restarted.Usage()[fp])
+	})
+
+	t.Run("flush error", func(t *testing.T) {
+		// 统计文件所在目录不存在, 写入失败
+		_, serverCtx := newTestConfig(t)
+		serverCtx.AccountingPath = filepath.Join(t.TempDir(), "missing", "usage.json")
+		serverCtx.AccountingInterval = 10 * time.Millisecond
+		errCh := make(chan error, 1)
+		serverCtx.OnAccountingError = func(err error) {
+			select {
+			case errCh <- err:
+			default:
+			}
+		}
+		serverCtx.Usage()
+		select {
+		case err := <-errCh:
+			assert.ErrorIs(t, err, os.ErrNotExist)
+		case <-time.After(2 * time.Second):
+			t.Fatal("error not reported")
+		}
+	})
+
+	t.Run("untracked key", func(t *testing.T) {
+		// 没有 KeyPolicy 且不在 AuthorizedKeys 中的公钥不统计
+		clientConfig, serverCtx := newTestConfig(t)
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+		_, err = client.Write(data)
+		require.NoError(t, err)
+		_, err = io.ReadFull(server, make([]byte, len(data)))
+		require.NoError(t, err)
+		assert.Empty(t, serverCtx.Usage())
+	})
+
+	t.Run("evict", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "usage.json")
+		now := usagePeriod(time.Now())
+		saved := map[string]Usage{
+			"SHA256:old": {Period: "2000-01", Read: 1},
+			"SHA256:new": {Period: now, Read: 2},
+		}
+		b, err := json.Marshal(saved)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, b, 0o600))
+
+		// 读取时跳过过去周期的流量
+		_, serverCtx := newTestConfig(t)
+		serverCtx.AccountingPath = path
+		assert.Equal(t, map[string]Usage{"SHA256:new": saved["SHA256:new"]}, serverCtx.Usage())
+
+		// 进入新周期后没有连接的公钥被删除
+		a := &serverCtx.acct
+		a.mu.Lock()
+		a.usage["SHA256:new"].period = "2000-02"
+		a.mu.Unlock()
+		require.NoError(t, serverCtx.FlushUsage())
+		assert.Empty(t, serverCtx.Usage())
+	})
+
+	t.Run("quota close", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		serverCtx.KeyPolicies = map[string]KeyPolicy{fp: {MonthlyQuota: 4096}}
+
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+		go client.Write(data)
+		_, err = io.ReadFull(server, make([]byte, len(data)))
+		assert.ErrorIs(t, err, ErrQuotaExceeded)
+
+		// 配额用尽后拒绝新连接
+		_, _, err = newTestConns(t, clientConfig, serverCtx)
+		assert.ErrorIs(t, err, ErrQuotaExceeded)
+	})
+
+	t.Run("quota throttle", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		serverCtx.KeyPolicies = map[string]KeyPolicy{fp: {MonthlyQuota: 4096, QuotaThrottle: 64 * 1024}}
+
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+		assert.Equal(t, rate.Inf, server.stat.usage.throttle.r.Limit())
+
+		_, err = client.Write(data)
+		require.NoError(t, err)
+		_, err = io.ReadFull(server, make([]byte, len(data)))
+		require.NoError(t, err)
+		assert.Equal(t, rate.Limit(64*1024), server.stat.usage.throttle.r.Limit())
+		assert.Equal(t, rate.Limit(64*1024), server.stat.usage.throttle.w.Limit())
+	})
+}
@@ -0,0 +1,147 @@
+package stcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/taodev/stcp/key"
+)
+
+// ErrAddrNotAllowed 表示来源地址不在允许的网段内
+var ErrAddrNotAllowed = errors.New("stcp: address not allowed")
+
+type ACLConfig struct {
+	// 允许连接的来源网段 (CIDR 或单个 IP), 为空时允许所有地址
+	AllowCIDRs []string `yaml:"allow_cidrs"`
+	// 拒绝连接的来源网段, 优先于 AllowCIDRs
+	DenyCIDRs []string `yaml:"deny_cidrs"`
+}
+
+// parsePrefix 解析 CIDR 或单个 IP
+func parsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("stcp: invalid cidr: %q", s)
+		}
+		return p.Masked(), nil
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("stcp: invalid cidr: %q", s)
+	}
+	ip = ip.Unmap()
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// parsePrefixes 解析网段列表
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		p, err := parsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// aclRules 解析后的 ACLConfig 和 KeyPolicy.From, ServerContext 第一次使用时解析, 之后修改配置不生效
+type aclRules struct {
+	once  sync.Once
+	allow []netip.Prefix
+	deny  []netip.Prefix
+	from  map[string][]netip.Prefix // 键为公钥指纹
+	err   error
+}
+
+func (r *aclRules) parse(ctx *ServerContext) (err error) {
+	if r.allow, err = parsePrefixes(ctx.AllowCIDRs); err != nil {
+		return err
+	}
+	if r.deny, err = parsePrefixes(ctx.DenyCIDRs); err != nil {
+		return err
+	}
+	for fp, policy := range ctx.KeyPolicies {
+		from, err := parsePrefixes(policy.From)
+		if err != nil {
+			return err
+		}
+		if len(from) > 0 {
+			if r.from == nil {
+				r.from = make(map[string][]netip.Prefix)
+			}
+			r.from[fp] = from
+		}
+	}
+	return nil
+}
+
+func (ctx *ServerContext) aclRules() *aclRules {
+	r := &ctx.acl
+	r.once.Do(func() { r.err = r.parse(ctx) })
+	return r
+}
+
+// matchPrefixes 地址是否在任一网段内
+func matchPrefixes(ip netip.Addr, prefixes []netip.Prefix) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedIP 检查来源地址, 无法解析的地址时拒绝
+func allowedIP(addr net.Addr, allow, deny []netip.Prefix) bool {
+	ip, err := netip.ParseAddr(addrIP(addr))
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap().WithZone("")
+	if matchPrefixes(ip, deny) {
+		return false
+	}
+	return len(allow) == 0 || matchPrefixes(ip, allow)
+}
+
+// allowed 检查连接的来源地址是否在 AllowCIDRs 内且不在 DenyCIDRs 内, 监听器在 Accept 时和服务端握手前检查
+// 配置错误时拒绝
+func (ctx *ServerContext) allowed(c net.Conn) bool {
+	r := ctx.aclRules()
+	if r.err != nil {
+		return false
+	}
+	if len(r.allow) == 0 && len(r.deny) == 0 {
+		return true
+	}
+	return allowedIP(c.RemoteAddr(), r.allow, r.deny)
+}
+
+// keyAllowed 检查客户端公钥的 KeyPolicy.From 限制, 在认证通过后检查
+func (ctx *ServerContext) keyAllowed(peerKey []byte, c net.Conn) bool {
+	r := ctx.aclRules()
+	if r.err != nil {
+		return false
+	}
+	from := r.from[key.Fingerprint(peerKey)]
+	if len(from) == 0 {
+		return true
+	}
+	return allowedIP(c.RemoteAddr(), from, nil)
+}
+
+// checkACL 检查 AllowCIDRs、DenyCIDRs 和 KeyPolicy.From 的格式
+func (ctx *ServerContext) checkACL() error {
+	return ctx.aclRules().err
+}
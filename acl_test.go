@@ -0,0 +1,93 @@
+package stcp
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/taodev/stcp/key"
+)
+
+func TestACL(t *testing.T) {
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+
+	t.Run("match", func(t *testing.T) {
+		allow, err := parsePrefixes([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+		require.NoError(t, err)
+		deny, err := parsePrefixes([]string{"10.1.0.0/16"})
+		require.NoError(t, err)
+		assert.True(t, allowedIP(addr("10.2.3.4"), allow, deny))
+		assert.True(t, allowedIP(addr("192.0.2.1"), allow, deny))
+		assert.True(t, allowedIP(addr("::ffff:10.2.3.4"), allow, deny))
+		assert.True(t, allowedIP(addr("2001:db8::1"), allow, deny))
+		assert.False(t, allowedIP(addr("10.1.2.3"), allow, deny))
+		assert.False(t, allowedIP(addr("192.0.2.2"), allow, deny))
+		// 只有拒绝列表时允许其他地址
+		assert.True(t, allowedIP(addr("192.0.2.2"), nil, deny))
+		assert.False(t, allowedIP(addr("10.1.2.3"), nil, deny))
+		_, err = parsePrefixes([]string{"10.0.0.0/8", "bad"})
+		assert.Error(t, err)
+	})
+
+	t.Run("check", func(t *testing.T) {
+		_, serverCtx := newTestConfig(t)
+		serverCtx.AllowCIDRs = []string{"10.0.0.0/8"}
+		assert.NoError(t, serverCtx.checkACL())
+
+		_, serverCtx = newTestConfig(t)
+		serverCtx.KeyPolicies = map[string]KeyPolicy{"SHA256:x": {From: []string{"10.0.0.0/33"}}}
+		assert.Error(t, serverCtx.checkACL())
+		_, err := Listen("tcp", "127.0.0.1:0", serverCtx)
+		assert.Error(t, err)
+
+		// NewListener 在 Accept 时返回配置错误, 握手前拒绝连接
+		inner := newLocalListener(t)
+		ln := NewListener(inner, serverCtx)
+		defer ln.Close()
+		_, err = ln.Accept()
+		assert.ErrorContains(t, err, "invalid cidr")
+		assert.False(t, serverCtx.allowed(&net.TCPConn{}))
+	})
+
+	t.Run("listener", func(t *testing.T) {
+		_, serverCtx := newTestConfig(t)
+		serverCtx.DenyCIDRs = []string{"127.0.0.0/8"}
+		ln, err := Listen("tcp", "127.0.0.1:0", serverCtx)
+		require.NoError(t, err)
+		defer ln.Close()
+
+		// 拒绝的连接直接关闭
+		go ln.Accept()
+		raw, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		defer raw.Close()
+		raw.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = raw.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("key from", func(t *testing.T) {
+		pub, err := key.PublicKey(testClientKey)
+		require.NoError(t, err)
+		fp := key.Fingerprint(pub)
+
+		clientConfig, serverCtx := newTestConfig(t)
+		serverCtx.KeyPolicies = map[string]KeyPolicy{fp: {From: []string{"192.0.2.0/24"}}}
+		_, _, err = newTestConns(t, clientConfig, serverCtx)
+		assert.ErrorIs(t, err, ErrAddrNotAllowed)
+
+		// 网段在第一次使用时解析, 修改配置需要新的 ServerContext
+		clientConfig, serverCtx = newTestConfig(t)
+		serverCtx.KeyPolicies = map[string]KeyPolicy{fp: {From: []string{"127.0.0.1"}}}
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		client.Close()
+		server.Close()
+	})
+}
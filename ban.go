@@ -0,0 +1,168 @@
+package stcp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBanned 表示来源地址因多次握手失败被封禁
+var ErrBanned = errors.New("stcp: address banned")
+
+type BanConfig struct {
+	// BanWindow 内握手失败达到该次数时封禁来源 IP, 为 0 时不封禁
+	BanThreshold int `yaml:"ban_threshold"`
+	// 统计握手失败的滑动窗口
+	BanWindow time.Duration `yaml:"ban_window" default:"10m"`
+	// 首次封禁的时长, 之后每次封禁时长加倍
+	BanDuration time.Duration `yaml:"ban_duration" default:"10m"`
+	// 最长封禁时长, 超过该时间没有再被封禁时重新从 BanDuration 开始
+	MaxBanDuration time.Duration `yaml:"max_ban_duration" default:"24h"`
+}
+
+// Ban 被封禁的来源地址
+type Ban struct {
+	IP string
+	// 解除封禁的时间
+	Until time.Time
+	// 累计封禁次数
+	Count int
+}
+
+// banRecord 单个来源 IP 的握手失败记录
+type banRecord struct {
+	failures []time.Time
+	until    time.Time
+	count    int
+}
+
+// banList 按来源 IP 统计握手失败
+type banList struct {
+	mu      sync.Mutex
+	records map[string]*banRecord
+}
+
+// banned 检查连接的来源 IP 是否被封禁, 监听器在 Accept 时和服务端握手前检查
+func (ctx *ServerContext) banned(c net.Conn) bool {
+	if ctx.BanThreshold <= 0 {
+		return false
+	}
+	ip := addrIP(c.RemoteAddr())
+	b := &ctx.bans
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := b.records[ip]
+	return r != nil && time.Now().Before(r.until)
+}
+
+// handshakeFailed 记录一次握手失败, 达到 BanThreshold 时封禁来源 IP
+func (ctx *ServerContext) handshakeFailed(c net.Conn, err error) {
+	if ctx.BanThreshold <= 0 || !countsAsFailure(err) {
+		return
+	}
+	ip := addrIP(c.RemoteAddr())
+	b := &ctx.bans
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.records == nil {
+		b.records = make(map[string]*banRecord)
+	}
+	r := b.records[ip]
+	if r == nil {
+		r = new(banRecord)
+		b.records[ip] = r
+	}
+	r.failures = append(pruneFailures(r.failures, now.Add(-ctx.BanWindow)), now)
+	if len(r.failures) < ctx.BanThreshold {
+		return
+	}
+
+	// 上次封禁结束超过 MaxBanDuration 后重新计算时长
+	if !r.until.IsZero() && now.Sub(r.until) > ctx.MaxBanDuration {
+		r.count = 0
+	}
+	d := ctx.BanDuration
+	for i := 0; i < r.count && d < ctx.MaxBanDuration; i++ {
+		d *= 2
+	}
+	r.until = now.Add(min(d, ctx.MaxBanDuration))
+	r.count++
+	r.failures = nil
+}
+
+// countsAsFailure 只计入对端造成的失败: 重放、认证失败、对端超时、握手中途关闭连接、来源不允许
+// 本地关闭连接和服务端自身状态 (连接数、配额、流量统计等) 导致的失败不计入
+// 没有发送任何握手数据就关闭的连接 (io.EOF) 不计入, 例如负载均衡的 TCP 健康检查
+func countsAsFailure(err error) bool {
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+		return false
+	}
+	for _, target := range []error{errReplay, errSign, errPeerKey, ErrAddrNotAllowed, os.ErrDeadlineExceeded, io.ErrUnexpectedEOF} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneFailures 删除 since 之前的失败记录
+func pruneFailures(failures []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(failures) && failures[i].Before(since) {
+		i++
+	}
+	return failures[i:]
+}
+
+// Bans 返回当前被封禁的来源地址, 按 IP 排序
+func (ctx *ServerContext) Bans() []Ban {
+	b := &ctx.bans
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var bans []Ban
+	for ip, r := range b.records {
+		if now.Before(r.until) {
+			bans = append(bans, Ban{IP: ip, Until: r.until, Count: r.count})
+		}
+	}
+	slices.SortFunc(bans, func(a, b Ban) int {
+		return strings.Compare(a.IP, b.IP)
+	})
+	return bans
+}
+
+// Unban 解除来源 IP 的封禁并清除失败记录
+func (ctx *ServerContext) Unban(ip string) {
+	b := &ctx.bans
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.records, ip)
+}
+
+// ClearBans 解除所有封禁并清除失败记录
+func (ctx *ServerContext) ClearBans() {
+	b := &ctx.bans
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.records = nil
+}
+
+// banGC 删除过期的记录
+func (ctx *ServerContext) banGC(now time.Time) {
+	b := &ctx.bans
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ip, r := range b.records {
+		r.failures = pruneFailures(r.failures, now.Add(-ctx.BanWindow))
+		if len(r.failures) == 0 && now.Sub(r.until) > ctx.MaxBanDuration {
+			delete(b.records, ip)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package stcp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c testAddrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestBan(t *testing.T) {
+	newCtx := func(t *testing.T) *ServerContext {
+		_, serverCtx := newTestConfig(t)
+		serverCtx.BanThreshold = 3
+		serverCtx.BanDuration = time.Minute
+		serverCtx.MaxBanDuration = 3 * time.Minute
+		return serverCtx
+	}
+	conn := testAddrConn{addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}}
+	other := testAddrConn{addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}}
+
+	t.Run("threshold", func(t *testing.T) {
+		serverCtx := newCtx(t)
+		for range 2 {
+			serverCtx.handshakeFailed(conn, errSign)
+		}
+		// 限制类错误不计入
+		serverCtx.handshakeFailed(conn, ErrTooManyConns)
+		assert.False(t, serverCtx.banned(conn))
+
+		serverCtx.handshakeFailed(conn, errSign)
+		assert.True(t, serverCtx.banned(conn))
+		assert.False(t, serverCtx.banned(other))
+
+		bans := serverCtx.Bans()
+		require.Len(t, bans, 1)
+		assert.Equal(t, "192.0.2.1", bans[0].IP)
+		assert.Equal(t, 1, bans[0].Count)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), bans[0].Until, time.Second)
+
+		serverCtx.Unban("192.0.2.1")
+		assert.False(t, serverCtx.banned(conn))
+		assert.Empty(t, serverCtx.Bans())
+	})
+
+	t.Run("peer failures", func(t *testing.T) {
+		// 对端造成的失败
+		for _, err := range []error{
+			errSign,
+			fmt.Errorf("hello %w", errSign),
+			fmt.Errorf("%w: %d", errReplay, 1),
+			fmt.Errorf("ecdh error: %w: %w", errPeerKey, errors.New("low order point")),
+			fmt.Errorf("read error: %w", io.ErrUnexpectedEOF),
+			&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded},
+			ErrAddrNotAllowed,
+		} {
+			assert.True(t, countsAsFailure(err), err.Error())
+		}
+		// 本地关闭和服务端自身状态导致的失败
+		for _, err := range []error{
+			fmt.Errorf("read error: %w", net.ErrClosed),
+			// 没有发送任何数据就关闭, 例如 TCP 健康检查
+			fmt.Errorf("read error: %w", io.EOF),
+			io.ErrClosedPipe,
+			ErrServerClosed,
+			ErrBanned,
+			ErrTooManyConns,
+			ErrQuotaExceeded,
+			errors.New("stcp: accounting error"),
+			errors.New("legacy client rejected"),
+		} {
+			assert.False(t, countsAsFailure(err), err.Error())
+		}
+	})
+
+	t.Run("escalate", func(t *testing.T) {
+		serverCtx := newCtx(t)
+		for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+			for range 3 {
+				serverCtx.handshakeFailed(conn, errSign)
+			}
+			bans := serverCtx.Bans()
+			require.Len(t, bans, 1)
+			assert.WithinDuration(t, time.Now().Add(want), bans[0].Until, time.Second)
+		}
+		serverCtx.ClearBans()
+		assert.Empty(t, serverCtx.Bans())
+	})
+
+	t.Run("window", func(t *testing.T) {
+		serverCtx := newCtx(t)
+		serverCtx.BanWindow = 50 * time.Millisecond
+		serverCtx.handshakeFailed(conn, errSign)
+		serverCtx.handshakeFailed(conn, errSign)
+		time.Sleep(100 * time.Millisecond)
+		serverCtx.handshakeFailed(conn, errSign)
+		assert.False(t, serverCtx.banned(conn))
+	})
+
+	t.Run("listener", func(t *testing.T) {
+		serverCtx := newCtx(t)
+		serverCtx.BanThreshold = 1
+		ln, err := Listen("tcp", "127.0.0.1:0", serverCtx)
+		require.NoError(t, err)
+		defer ln.Close()
+
+		// 发送无效握手数据
+		go func() {
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			c.Write(make([]byte, packetSizeV1))
+		}()
+		c, err := ln.Accept()
+		require.NoError(t, err)
+		assert.Error(t, c.(*Conn).Handshake())
+		c.Close()
+		require.Len(t, serverCtx.Bans(), 1)
+
+		// 被封禁后连接直接关闭
+		go ln.Accept()
+		raw, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		defer raw.Close()
+		raw.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = raw.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
@@ -0,0 +1,97 @@
+package stcp
+
+import (
+	"io"
+	"time"
+)
+
+type BufferConfig struct {
+	// 开启缓冲写入, Write 只写入缓冲区, 数据在 Flush、自动刷新或缓冲达到阈值时发送
+	// 默认关闭, 每次 Write 立即发送
+	WriteBuffered bool `yaml:"write_buffered"`
+	// 自动刷新延迟, 缓冲区有数据后最多等待该时间发送, 为 0 时不自动刷新
+	FlushDelay time.Duration `yaml:"flush_delay"`
+	// 缓冲数据达到该大小时立即发送, 为 0 时缓冲区满 (64KB) 才发送
+	FlushSize int `yaml:"flush_size"`
+}
+
+func (c *Conn) bufferConfig() *BufferConfig {
+	if c.clientConfig != nil {
+		return &c.clientConfig.BufferConfig
+	}
+	if c.serverCtx != nil {
+		return &c.serverCtx.BufferConfig
+	}
+	return nil
+}
+
+// Flush 发送缓冲区中的数据, 非缓冲模式下 Write 已立即发送, 无需调用
+func (c *Conn) Flush() error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	c.out.Lock()
+	defer c.out.Unlock()
+	if c.closed.Load() {
+		return io.ErrClosedPipe
+	}
+	if c.writeClosed {
+		return nil
+	}
+	return c.wrapErr(c.flush())
+}
+
+// 未设置 FlushSize 时缓冲区的大小
+const defaultFlushSize = 64 * 1024
+
+// flush 发送缓冲区中的数据, 调用方需持有写锁
+func (c *Conn) flush() error {
+	if len(c.wbuf) == 0 {
+		return nil
+	}
+	_, err := c.writeData(c.wbuf)
+	c.wbuf = c.wbuf[:0]
+	return err
+}
+
+// writeBuffered 将 b 写入缓冲区, 达到阈值时立即发送, 否则安排自动刷新, 调用方需持有写锁
+func (c *Conn) writeBuffered(cfg *BufferConfig, b []byte) (n int, err error) {
+	limit := cfg.FlushSize
+	if limit <= 0 {
+		limit = defaultFlushSize
+	}
+	if len(b) >= limit {
+		// 大块数据不经过缓冲区, 先发送已缓冲的数据保证顺序
+		if err = c.flush(); err != nil {
+			return
+		}
+		return c.writeData(b)
+	}
+	if c.wbuf == nil {
+		c.wbuf = make([]byte, 0, 2*limit)
+	}
+	c.wbuf = append(c.wbuf, b...)
+	n = len(b)
+	if len(c.wbuf) >= limit {
+		// 达到阈值, 连同之前缓冲的数据一起发送
+		return n, c.flush()
+	}
+	if cfg.FlushDelay > 0 && len(c.wbuf) > 0 && !c.flushArmed {
+		c.flushArmed = true
+		time.AfterFunc(cfg.FlushDelay, c.autoFlush)
+	}
+	return
+}
+
+func (c *Conn) autoFlush() {
+	c.out.Lock()
+	defer c.out.Unlock()
+	c.flushArmed = false
+	if c.closed.Load() || c.writeClosed {
+		return
+	}
+	// 发送失败后连接已不可用, 之后的读写返回该错误
+	if err := c.flush(); err != nil {
+		c.abort(err)
+	}
+}
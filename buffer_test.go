@@ -0,0 +1,104 @@
+package stcp
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnBuffered(t *testing.T) {
+	written := func(c *Conn) int64 {
+		_, _, _, outW := c.Stat()
+		return outW
+	}
+
+	t.Run("flush", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		clientConfig.WriteBuffered = true
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+
+		for i := 0; i < 10; i++ {
+			_, err = client.Write([]byte("hello"))
+			require.NoError(t, err)
+		}
+		assert.Zero(t, written(client))
+
+		require.NoError(t, client.Flush())
+		assert.NotZero(t, written(client))
+
+		buf := make([]byte, 50)
+		_, err = io.ReadFull(server, buf)
+		require.NoError(t, err)
+
+		// CloseWrite 先发送缓冲区中的数据
+		_, err = client.Write([]byte("world"))
+		require.NoError(t, err)
+		require.NoError(t, client.CloseWrite())
+		data, err := io.ReadAll(server)
+		require.NoError(t, err)
+		assert.Equal(t, "world", string(data))
+
+		_, err = client.Write([]byte("hello"))
+		assert.ErrorIs(t, err, errShutdown)
+		assert.NoError(t, client.Flush())
+	})
+
+	t.Run("flush size", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		clientConfig.WriteBuffered = true
+		clientConfig.FlushSize = 100
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+
+		_, err = client.Write(make([]byte, 60))
+		require.NoError(t, err)
+		assert.Zero(t, written(client))
+		_, err = client.Write(make([]byte, 60))
+		require.NoError(t, err)
+		assert.NotZero(t, written(client))
+
+		_, err = io.ReadFull(server, make([]byte, 120))
+		require.NoError(t, err)
+	})
+
+	t.Run("flush delay", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		clientConfig.WriteBuffered = true
+		clientConfig.FlushDelay = 10 * time.Millisecond
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+
+		for i := 0; i < 10; i++ {
+			_, err = client.Write([]byte("hello"))
+			require.NoError(t, err)
+		}
+		// 延迟内的多次写入合并发送
+		buf := make([]byte, 50)
+		_, err = io.ReadFull(server, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "hellohello", string(buf[:10]))
+	})
+
+	t.Run("default", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+
+		_, err = client.Write([]byte("hello"))
+		require.NoError(t, err)
+		assert.NotZero(t, written(client))
+		require.NoError(t, client.Flush())
+	})
+}
@@ -36,4 +36,5 @@ func main() {
 		os.Exit(1)
 	}
 	fmt.Println("publicKey:", publicKey)
+	fmt.Println("fingerprint:", key.Fingerprint(publicKey))
 }
@@ -0,0 +1,165 @@
+package stcp
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// 压缩算法
+// 压缩按帧进行, 压缩后不能变小的帧按原始数据发送
+const (
+	CompressNone   = "none"
+	CompressSnappy = "snappy"
+	CompressZstd   = "zstd"
+	CompressLZ4    = "lz4"
+)
+
+// 握手中使用的压缩算法编号
+const (
+	compressNone uint8 = iota
+	compressSnappy
+	compressZstd
+	compressLZ4
+)
+
+var compressNames = []string{CompressNone, CompressSnappy, CompressZstd, CompressLZ4}
+
+// defaultCompression 客户端未配置压缩算法时使用
+var defaultCompression = []string{CompressSnappy}
+
+var errUncompressed = errors.New("stcp: compressed frame without compression")
+
+func compressID(name string) (uint8, error) {
+	i := slices.Index(compressNames, name)
+	if i < 0 {
+		return 0, fmt.Errorf("stcp: unsupported compression: %s", name)
+	}
+	return uint8(i), nil
+}
+
+func compressIDs(names []string) ([]uint8, error) {
+	ids := make([]uint8, 0, len(names))
+	for _, name := range names {
+		id, err := compressID(name)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// selectCompression 按客户端优先级选择服务端允许的压缩算法, 服务端未配置时允许所有算法
+// 没有共同算法时不压缩
+func selectCompression(server, client []uint8) uint8 {
+	for _, id := range client {
+		if int(id) >= len(compressNames) {
+			continue
+		}
+		if len(server) == 0 || slices.Contains(server, id) {
+			return id
+		}
+	}
+	return compressNone
+}
+
+// codec 单帧压缩算法
+type codec interface {
+	// maxEncodedLen 返回长度为 n 的数据压缩后的最大长度
+	maxEncodedLen(n int) int
+	// encode 压缩 src 到 dst, dst 长度不小于 maxEncodedLen, 返回 nil 表示无法压缩
+	encode(dst, src []byte) []byte
+	// decode 解压 src 到 dst, 解压后超过 dst 长度时返回错误
+	decode(dst, src []byte) (int, error)
+}
+
+func newCodec(id uint8) codec {
+	switch id {
+	case compressSnappy:
+		return snappyCodec{}
+	case compressZstd:
+		return zstdCodec{}
+	case compressLZ4:
+		return lz4Codec{}
+	}
+	return nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) maxEncodedLen(n int) int {
+	return snappy.MaxEncodedLen(n)
+}
+
+func (snappyCodec) encode(dst, src []byte) []byte {
+	return snappy.Encode(dst, src)
+}
+
+func (snappyCodec) decode(dst, src []byte) (int, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return 0, err
+	}
+	if n > len(dst) {
+		return 0, errors.New("stcp: decompressed frame too long")
+	}
+	b, err := snappy.Decode(dst, src)
+	return len(b), err
+}
+
+var (
+	// EncodeAll 和 DecodeAll 可以并发调用, 所有连接共用
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		e, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithZeroFrames(true))
+		return e
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		d, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxFrameSizeLimit))
+		return d
+	})
+)
+
+type zstdCodec struct{}
+
+func (zstdCodec) maxEncodedLen(n int) int {
+	return zstdEncoder().MaxEncodedSize(n)
+}
+
+func (zstdCodec) encode(dst, src []byte) []byte {
+	return zstdEncoder().EncodeAll(src, dst[:0])
+}
+
+func (zstdCodec) decode(dst, src []byte) (int, error) {
+	b, err := zstdDecoder().DecodeAll(src, dst[:0])
+	if err != nil {
+		return 0, err
+	}
+	if len(b) > len(dst) {
+		return 0, errors.New("stcp: decompressed frame too long")
+	}
+	return len(b), nil
+}
+
+type lz4Codec struct{}
+
+func (lz4Codec) maxEncodedLen(n int) int {
+	return lz4.CompressBlockBound(n)
+}
+
+func (lz4Codec) encode(dst, src []byte) []byte {
+	n, err := lz4.CompressBlock(src, dst, nil)
+	if err != nil || n == 0 {
+		return nil
+	}
+	return dst[:n]
+}
+
+func (lz4Codec) decode(dst, src []byte) (int, error) {
+	return lz4.UncompressBlock(src, dst)
+}
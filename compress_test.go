@@ -0,0 +1,139 @@
+package stcp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodec(t *testing.T) {
+	text := bytes.Repeat([]byte("stcp compression test "), 200)
+	random := make([]byte, len(text))
+	rand.Read(random)
+
+	for _, name := range compressNames[1:] {
+		id, err := compressID(name)
+		require.NoError(t, err)
+		c := newCodec(id)
+		require.NotNil(t, c, name)
+
+		buf := make([]byte, c.maxEncodedLen(len(text)))
+		enc := c.encode(buf, text)
+		require.NotNil(t, enc, name)
+		assert.Less(t, len(enc), len(text), name)
+
+		dst := make([]byte, len(text))
+		n, err := c.decode(dst, enc)
+		require.NoError(t, err, name)
+		assert.Equal(t, text, dst[:n], name)
+
+		// 解压后超过缓冲区长度
+		_, err = c.decode(make([]byte, len(text)/2), enc)
+		assert.Error(t, err, name)
+
+		// 无法压缩的数据不会变小
+		if enc := c.encode(buf, random); enc != nil {
+			assert.GreaterOrEqual(t, len(enc), len(random), name)
+		}
+	}
+
+	assert.Nil(t, newCodec(compressNone))
+	_, err := compressID("gzip")
+	assert.ErrorContains(t, err, "unsupported compression")
+}
+
+func TestSelectCompression(t *testing.T) {
+	assert.Equal(t, compressZstd, selectCompression(nil, []uint8{compressZstd, compressSnappy}))
+	assert.Equal(t, compressSnappy, selectCompression([]uint8{compressSnappy, compressLZ4}, []uint8{compressZstd, compressSnappy}))
+	assert.Equal(t, compressNone, selectCompression([]uint8{compressLZ4}, []uint8{compressZstd, compressSnappy}))
+	assert.Equal(t, compressLZ4, selectCompression(nil, []uint8{0xff, compressLZ4}))
+}
+
+func TestConnCompression(t *testing.T) {
+	text := bytes.Repeat([]byte("stcp compression test "), 1000)
+	random := make([]byte, len(text))
+	rand.Read(random)
+
+	// transfer 发送 data 并返回底层连接写入的字节数
+	transfer := func(t *testing.T, client, server *Conn, data []byte, sensitive bool) int64 {
+		_, _, _, before := client.Stat()
+		errCh := make(chan error, 1)
+		go func() {
+			var err error
+			if sensitive {
+				_, err = client.WriteSensitive(data)
+			} else {
+				_, err = client.Write(data)
+			}
+			errCh <- err
+		}()
+		got := make([]byte, len(data))
+		_, err := io.ReadFull(server, got)
+		require.NoError(t, err)
+		require.NoError(t, <-errCh)
+		assert.Equal(t, data, got)
+		_, _, _, after := client.Stat()
+		return after - before
+	}
+
+	for _, name := range compressNames {
+		t.Run(name, func(t *testing.T) {
+			clientConfig, serverCtx := newTestConfig(t)
+			clientConfig.Compression = []string{name}
+			client, server, err := newTestConns(t, clientConfig, serverCtx)
+			require.NoError(t, err)
+			defer client.Close()
+			defer server.Close()
+
+			assert.Equal(t, name, client.ConnectionState().Compression)
+			assert.Equal(t, name, server.ConnectionState().Compression)
+
+			n := transfer(t, client, server, text, false)
+			if name == CompressNone {
+				assert.Greater(t, n, int64(len(text)))
+			} else {
+				assert.Less(t, n, int64(len(text)))
+			}
+
+			// 无法压缩的数据按原始数据发送, 不会比不压缩更大
+			frames := int64(len(random)+gcmPacketSize-1) / gcmPacketSize
+			n = transfer(t, client, server, random, false)
+			assert.Equal(t, int64(len(random))+frames*(gcmHeaderSize+gcmTagSize), n)
+
+			// 敏感数据不压缩
+			n = transfer(t, client, server, text, true)
+			assert.Greater(t, n, int64(len(text)))
+		})
+	}
+
+	t.Run("negotiate", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		clientConfig.Compression = []string{CompressZstd, CompressLZ4, CompressNone}
+		serverCtx.Compression = []string{CompressLZ4, CompressNone}
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+		assert.Equal(t, CompressLZ4, client.ConnectionState().Compression)
+		assert.Equal(t, CompressLZ4, server.ConnectionState().Compression)
+	})
+
+	t.Run("default not allowed", func(t *testing.T) {
+		// 客户端使用默认配置时不等待回复, 服务端不允许 snappy 则握手失败
+		clientConfig, serverCtx := newTestConfig(t)
+		serverCtx.Compression = []string{CompressNone}
+		_, _, err := newTestConns(t, clientConfig, serverCtx)
+		assert.ErrorContains(t, err, "compression not allowed")
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		clientConfig, _ := newTestConfig(t)
+		clientConfig.Compression = []string{"gzip"}
+		_, err := clientHandshake(io.Discard, clientConfig)
+		assert.ErrorContains(t, err, "unsupported compression")
+	})
+}
@@ -2,7 +2,9 @@ package stcp
 
 import (
 	"crypto/rand"
+	"fmt"
 	"io"
+	"net"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,6 +14,9 @@ import (
 
 type ClientConfig struct {
 	LimitConfig
+	KeepAliveConfig
+	LifetimeConfig
+	BufferConfig
 
 	Rand io.Reader `yaml:"-"`
 
@@ -29,10 +34,34 @@ type ClientConfig struct {
 	// 加密类型
 	// 支持 aes-256-gcm, chacha20-poly1305, xchacha20-poly1305
 	CryptoType string `yaml:"crypto_type" default:"aes-256-gcm"`
+
+	// 应用层协议列表, 按优先级排列
+	NextProtos []string `yaml:"next_protos"`
+
+	// 单帧最大明文长度, 握手时取双方的较小值
+	// 取值范围 4096 ~ 1048576, 超过 65519 时帧头长度字段为 4 字节
+	MaxFrameSize int `yaml:"max_frame_size" default:"4096"`
+
+	// 压缩算法, 按优先级排列, 为空时使用 snappy
+	// 支持 none, snappy, zstd, lz4, 与攻击者可控数据混合发送的敏感数据应使用 WriteSensitive 或 none
+	Compression []string `yaml:"compression"`
+
+	// 并行加解密的协程数, 大于 1 时开启, 帧的顺序不变, 适合多核高带宽链路
+	Parallel int `yaml:"parallel"`
+
+	// 使用原始协议连接未升级的服务端, 不发送 hello, 不支持协商、控制帧和自定义帧
+	// 未升级的服务端不接受默认的握手, 必须设置; 原始协议两个方向使用相同的密钥和 nonce 序列, 服务端升级后应关闭
+	Legacy bool `yaml:"legacy"`
 }
 
 type ServerContext struct {
 	LimitConfig
+	KeepAliveConfig
+	LifetimeConfig
+	BufferConfig
+	AccountingConfig
+	BanConfig
+	ACLConfig
 
 	Rand io.Reader `yaml:"-"`
 
@@ -40,27 +69,66 @@ type ServerContext struct {
 	HandshakeTimeout time.Duration `yaml:"handshake_timeout" default:"30s"`
 	// 容忍时间窗口 (秒)
 	Tolerance int64 `yaml:"tolerance" default:"120"`
-	// 最大并发数
+	// 最大并发数, 由监听器在 Accept 时限制, 为 0 时不限
 	MaxConns int `yaml:"max_conns" default:"1024"`
+	// 单个来源 IP 的最大并发数, 为 0 时不限
+	MaxConnsPerIP int `yaml:"max_conns_per_ip"`
+	// 单个客户端公钥的最大并发数, 为 0 时不限, KeyPolicy.MaxConns 优先
+	MaxConnsPerKey int `yaml:"max_conns_per_key"`
+	// 已接受但尚未完成握手的最大连接数, 为 0 时不限
+	MaxHandshakes int `yaml:"max_handshakes"`
+	// 监听器后台握手的并发数, 大于 0 时 Accept 只返回握手完成的连接
+	HandshakeWorkers int `yaml:"handshake_workers"`
+	// 后台握手失败时调用, 返回后连接被关闭
+	OnHandshakeError func(c net.Conn, err error) `yaml:"-"`
 
 	// ECDH
 	// 私钥: 使用 ecdh, 推荐
 	PrivateKey []byte `yaml:"private_key"`
 
+	// 拒绝使用原始协议的未升级客户端, 默认接受
+	// 原始协议两个方向使用相同的密钥和 nonce 序列, 安全性较弱, 所有客户端升级后应开启
+	RejectLegacy bool `yaml:"reject_legacy"`
+
 	// 公钥认证: 使用 ecdh, 推荐
+	// AuthorizedKeys 中的公钥按公钥统计流量, 见 AccountingConfig
 	AuthorizedKeys [][]byte `yaml:"authorized_keys"`
 	AuthorizedPath string   `yaml:"authorized_path"`
 
+	// 客户端公钥的策略, 键为公钥指纹, 格式与 key.Fingerprint 一致
+	KeyPolicies map[string]KeyPolicy `yaml:"key_policies"`
+
 	// 加密类型
 	// 支持 aes-256-gcm, chacha20-poly1305, xchacha20-poly1305
 	CryptoType string `yaml:"crypto_type" default:"aes-256-gcm"`
 
+	// 应用层协议列表, 按优先级排列
+	NextProtos []string `yaml:"next_protos"`
+
+	// 单帧最大明文长度, 握手时取双方的较小值
+	// 取值范围 4096 ~ 1048576, 超过 65519 时帧头长度字段为 4 字节
+	MaxFrameSize int `yaml:"max_frame_size" default:"4096"`
+
+	// 允许的压缩算法, 按客户端的优先级选择, 为空时允许所有算法
+	Compression []string `yaml:"compression"`
+
+	// 并行加解密的协程数, 大于 1 时开启, 帧的顺序不变, 适合多核高带宽链路
+	Parallel int `yaml:"parallel"`
+
+	limits limitGroup
+	acct   accounting
+	conns  connTracker
+	bans   banList
+	live   liveSet
+	acl    aclRules
+
 	idMap     map[uint64]int64 `yaml:"-"`
 	idMutex   sync.RWMutex     `yaml:"-"`
 	closeCh   chan struct{}    `yaml:"-"`
 	closeOnce sync.Once
 	wait      sync.WaitGroup
 	running   atomic.Bool
+	refs      atomic.Int64
 }
 
 func NewClientConfig() (cfg *ClientConfig, err error) {
@@ -77,15 +145,35 @@ func NewServerContext() (ctx *ServerContext, err error) {
 	ctx.Rand = rand.Reader
 	ctx.idMap = make(map[uint64]int64)
 	ctx.closeCh = make(chan struct{})
+	ctx.acct.started = make(chan struct{})
 	if err = defaults.Set(ctx); err != nil {
 		return nil, err
 	}
-	ctx.wait.Add(1)
+	ctx.wait.Add(2)
 	ctx.running.Store(true)
 	go ctx.replayGC()
+	go ctx.accountingLoop()
 	return ctx, nil
 }
 
+func (cfg *ClientConfig) compression() []string {
+	if len(cfg.Compression) == 0 {
+		return defaultCompression
+	}
+	return cfg.Compression
+}
+
+// frameSizeOf 校验配置的单帧大小, 为 0 时使用默认值
+func frameSizeOf(n int) (uint32, error) {
+	if n == 0 {
+		return gcmPacketSize, nil
+	}
+	if n < gcmPacketSize || n > maxFrameSizeLimit {
+		return 0, fmt.Errorf("stcp: invalid max frame size: %d", n)
+	}
+	return uint32(n), nil
+}
+
 func (ctx *ServerContext) CheckReplay(id uint64) bool {
 	if !ctx.running.Load() {
 		return true
@@ -107,6 +195,7 @@ func (ctx *ServerContext) replayGC() {
 	for {
 		select {
 		case <-ticker.C:
+			ctx.banGC(time.Now())
 			now := time.Now().Unix()
 			ctx.idMutex.Lock()
 			for id, t := range ctx.idMap {
@@ -122,6 +211,32 @@ func (ctx *ServerContext) replayGC() {
 	}
 }
 
+// closedRefs 最后一个引用释放后 refs 的值, 之后不能再持有引用
+const closedRefs = -1
+
+// Retain 持有一个引用, 使用同一个 ServerContext 的监听器会各自持有引用
+// 所有引用释放后 ServerContext 关闭, 需要在没有监听器时继续使用 (例如重新监听) 时调用, 用完后调用 Release
+// ServerContext 已关闭时返回 ErrServerClosed, 不持有引用
+func (ctx *ServerContext) Retain() error {
+	for {
+		n := ctx.refs.Load()
+		if n == closedRefs || !ctx.running.Load() {
+			return ErrServerClosed
+		}
+		if ctx.refs.CompareAndSwap(n, n+1) {
+			return nil
+		}
+	}
+}
+
+// Release 释放 Retain 持有的引用, 最后一个引用释放时关闭 ServerContext
+func (ctx *ServerContext) Release() {
+	if ctx.refs.Add(-1) == 0 && ctx.refs.CompareAndSwap(0, closedRefs) {
+		ctx.Close()
+	}
+}
+
+// Close 立即关闭 ServerContext, 停止重放检测和流量统计, 所有监听器和连接都不能再握手
 func (ctx *ServerContext) Close() {
 	ctx.closeOnce.Do(func() {
 		ctx.running.Store(false)
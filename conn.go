@@ -1,129 +1,319 @@
 package stcp
 
 import (
-	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/bytedance/gopkg/lang/mcache"
 )
 
+// 关闭时发送 EOF 帧的超时时间
+const closeNotifyTimeout = 5 * time.Second
+
+// Conn 是加密压缩后的连接
+// 与 net.Conn 一致, 支持一个读协程、一个写协程和任意协程并发调用 Close
 type Conn struct {
 	conn net.Conn
 
 	clientConfig *ClientConfig
 	serverCtx    *ServerContext
 
-	gcm cipher.AEAD // AES GCM 实例
-
 	gcmReader *SecureReader
 	gcmWriter *SecureWriter
+	legacy    *legacyStream // 原始协议的 snappy 流, 仅在与未升级的对端通信时使用
+
+	handshakeFn       func() error
+	handshakeOnce     sync.Once
+	handshakeErr      error // 仅在 handshakeOnce 中写入
+	handshakeComplete atomic.Bool
 
-	snappyReader *SnappyReader
-	snappyWriter *SnappyWriter
+	version           uint8
+	cryptoType        string
+	peerKey           []byte
+	protocol          string
+	frameSize         int
+	compress          uint8
+	handshakeTime     time.Time
+	handshakeDuration time.Duration
+	exporterSecret    []byte
 
-	handshakeFn   func() error
-	handshakeOnce sync.Once
+	in          sync.Mutex // 保护读路径
+	out         sync.Mutex // 保护写路径
+	closed      atomic.Bool
+	writeClosed bool   // 已发送 EOF 帧, 由 out 保护
+	wbuf        []byte // 缓冲模式下未发送的数据, 由 out 保护
+	flushArmed  bool   // 已安排自动刷新, 由 out 保护
 
-	stat *Stat
-	rn   int64
-	wn   int64
+	frameHandlers map[FrameType]FrameHandler // 自定义帧处理函数, 由 in 保护
 
-	err error
+	epoch       time.Time     // 握手完成时间, 作为 ping 时间戳的基准
+	done        chan struct{} // 连接关闭时关闭, 用于通知后台协程
+	abortErr    atomic.Pointer[error]
+	rtt         rttStats
+	pingSent    atomic.Bool
+	pendingPong atomic.Pointer[[pingPayloadSize]byte]
+	readSince   atomic.Int64  // 当前 Read 开始的时间, 没有在读取时为 0, 用于保活超时
+	goAwayCh    chan struct{} // 收到 GoAway 帧或服务端 Shutdown 时关闭
+	goAwayOnce  sync.Once
+
+	stat    *Stat     // 统计和限速, 截止时间和关闭都经过 stat
+	slot    *connSlot // 监听器接受的连接占用的名额
+	onClose []func()  // 关闭时释放服务端的连接名额、限速器和流量统计, 由 out 保护
+	rn      int64
+	wn      int64
 }
 
 func (c *Conn) LocalAddr() net.Addr {
-	if c.err != nil {
-		return nil
-	}
 	return c.conn.LocalAddr()
 }
 
 func (c *Conn) RemoteAddr() net.Addr {
-	if c.err != nil {
-		return nil
-	}
 	return c.conn.RemoteAddr()
 }
 
 func (c *Conn) SetDeadline(t time.Time) error {
-	if c.err != nil {
-		return c.err
+	if c.closed.Load() {
+		return io.ErrClosedPipe
 	}
-	return c.conn.SetDeadline(t)
+	return c.stat.SetDeadline(t)
 }
+
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	if c.err != nil {
-		return c.err
+	if c.closed.Load() {
+		return io.ErrClosedPipe
 	}
-	return c.conn.SetReadDeadline(t)
+	return c.stat.SetReadDeadline(t)
 }
 
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	if c.err != nil {
-		return c.err
+	if c.closed.Load() {
+		return io.ErrClosedPipe
 	}
-	return c.conn.SetWriteDeadline(t)
+	return c.stat.SetWriteDeadline(t)
 }
 
 func (c *Conn) NetConn() net.Conn {
 	return c.conn
 }
 
+// Close 关闭连接, 阻塞中的 Read、Write 和 Handshake 会立即返回错误
+// 握手已完成且没有进行中的写入时, 会先向对端发送 EOF 帧
 func (c *Conn) Close() (err error) {
-	if c.err == nil {
-		c.err = io.ErrClosedPipe
+	if !c.closed.CompareAndSwap(false, true) {
+		return nil
 	}
 
-	if c.conn != nil {
-		err = c.conn.Close()
-		c.conn = nil
+	// 有写入在进行时不发送 EOF 帧, 避免被阻塞的写入拖住 Close
+	var notifyErr error
+	if c.handshakeComplete.Load() && c.out.TryLock() {
+		if err = c.closeNotify(); err != nil {
+			notifyErr = fmt.Errorf("stcp: failed to send eof frame (but connection was closed anyway): %w", err)
+		}
+		c.out.Unlock()
 	}
 
-	c.conn = nil
-	c.clientConfig = nil
-	c.serverCtx = nil
-
-	c.gcm = nil
+	// 关闭底层连接, 让阻塞的读写和限速等待尽快返回并释放锁
+	err = c.stat.Close()
 
+	c.in.Lock()
 	if c.gcmReader != nil {
 		c.gcmReader.Close()
-		c.gcmReader = nil
 	}
+	c.in.Unlock()
 
+	c.out.Lock()
 	if c.gcmWriter != nil {
 		c.gcmWriter.Close()
-		c.gcmWriter = nil
 	}
+	if c.done != nil {
+		close(c.done)
+	}
+	for _, fn := range c.onClose {
+		fn()
+	}
+	c.onClose = nil
+	c.out.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return notifyErr
+}
+
+// CloseWrite 关闭写方向并向对端发送 EOF 帧, 之后仍然可以继续读取
+// 对端读完剩余数据后会收到 io.EOF, 只能在握手完成后调用
+func (c *Conn) CloseWrite() error {
+	if !c.handshakeComplete.Load() {
+		return errors.New("stcp: CloseWrite called before handshake complete")
+	}
+	c.out.Lock()
+	defer c.out.Unlock()
+	if c.closed.Load() {
+		return io.ErrClosedPipe
+	}
+	return c.closeWrite()
+}
+
+func (c *Conn) closeWrite() error {
+	if c.writeClosed {
+		return nil
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+	if err := c.gcmWriter.CloseWrite(); err != nil {
+		return err
+	}
+	c.writeClosed = true
+	return nil
+}
 
-	c.stat = nil
+// abort 因内部原因 (例如保活超时) 中断连接, 之后的读写返回 err
+func (c *Conn) abort(err error) {
+	if c.abortErr.CompareAndSwap(nil, &err) {
+		c.stat.Close()
+	}
+}
 
+// wrapErr 连接被中断时返回中断原因
+func (c *Conn) wrapErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if aerr := c.abortErr.Load(); aerr != nil {
+		return *aerr
+	}
 	return err
 }
 
-func (c *Conn) init(newAEAD newAEAD, key, nonce []byte) error {
-	c.stat = WrapStat(c.conn)
+// closeNotify 在关闭前发送 EOF 帧, 调用方需持有写锁
+func (c *Conn) closeNotify() error {
+	c.stat.SetWriteDeadline(time.Now().Add(closeNotifyTimeout))
+	return c.closeWrite()
+}
+
+// directionKey 从会话密钥派生单个方向的密钥
+func directionKey(key, nonce []byte, dir byte) ([]byte, error) {
+	info := "stcp client write"
+	if dir == dirServer {
+		info = "stcp server write"
+	}
+	return hkdfKey(sha256.New, key, nonce, info, len(key))
+}
+
+func (c *Conn) init(info *handshakeInfo) error {
+	c.version = info.version
+	c.cryptoType = info.cryptoType
+	c.peerKey = info.peerKey
+	c.protocol = info.protocol
+	c.frameSize = info.frameSize
+	c.compress = info.compress
+
+	newAEAD, key, nonce := info.newCrypto, info.key, info.nonce
+	exporterSecret, err := hkdfKey(sha256.New, key, nonce, exporterInfo, keySizeV1)
+	if err != nil {
+		return err
+	}
+	c.exporterSecret = exporterSecret
+	c.in.Lock()
+	defer c.in.Unlock()
+	c.out.Lock()
+	defer c.out.Unlock()
+	// 握手期间连接被关闭, 不再分配读写缓冲
+	if c.closed.Load() {
+		return io.ErrClosedPipe
+	}
+
 	if c.clientConfig != nil {
-		c.stat.rL = c.clientConfig.GetReadLimiter()
-		c.stat.wL = c.clientConfig.GetWriteLimiter()
+		c.stat.rL.ls = limiters(c.clientConfig.GetReadLimiter())
+		c.stat.wL.ls = limiters(c.clientConfig.GetWriteLimiter())
 	} else if c.serverCtx != nil {
-		c.stat.rL = c.serverCtx.GetReadLimiter()
-		c.stat.wL = c.serverCtx.GetWriteLimiter()
+		release, err := c.serverCtx.acquireKey(c.peerKey)
+		if err != nil {
+			return err
+		}
+		c.onClose = append(c.onClose, release)
+		usage, release, err := c.serverCtx.acquireUsage(c)
+		if err != nil {
+			return err
+		}
+		c.onClose = append(c.onClose, release)
+		c.stat.usage = usage
+		c.stat.rL, c.stat.wL, release = c.serverCtx.acquireLimiters(c.peerKey)
+		c.onClose = append(c.onClose, release)
+		// 配额用尽后的限速
+		c.stat.rL.ls = append(c.stat.rL.ls, usage.throttle.r)
+		c.stat.wL.ls = append(c.stat.wL.ls, usage.throttle.w)
 	}
 
-	aeadReader, err := newAEAD(key)
+	// 两个方向使用不同的密钥, 避免相同的密钥和 nonce 被重复使用
+	readDir, writeDir := byte(dirServer), byte(dirClient)
+	if c.clientConfig == nil {
+		readDir, writeDir = writeDir, readDir
+	}
+	readKey, writeKey := key, key
+	if c.version != VersionLegacy {
+		if readKey, err = directionKey(key, nonce, readDir); err != nil {
+			return err
+		}
+		if writeKey, err = directionKey(key, nonce, writeDir); err != nil {
+			return err
+		}
+	}
+
+	aeadReader, err := newAEAD(readKey)
 	if err != nil {
 		return err
 	}
-	c.gcmReader = NewSecureReader(c.stat, aeadReader, nonce)
-	aeadWriter, err := newAEAD(key)
+	c.gcmReader = NewSecureReaderSize(c.stat, aeadReader, nonce, c.frameSize)
+	c.gcmReader.bind(readDir, c.version)
+	aeadWriter, err := newAEAD(writeKey)
 	if err != nil {
 		return err
 	}
-	c.gcmWriter = NewSecureWriter(c.stat, aeadWriter, nonce)
-	c.snappyReader = NewSnappyReader(c.gcmReader)
-	c.snappyWriter = NewSnappyWriter(c.gcmWriter)
+	c.gcmWriter = NewSecureWriterSize(c.stat, aeadWriter, nonce, c.frameSize)
+	c.gcmWriter.bind(writeDir, c.version)
+	c.epoch = time.Now()
+	c.done = make(chan struct{})
+	if c.version == VersionLegacy {
+		// 原始协议: 整个连接是一个 snappy 流, 没有控制帧
+		c.gcmReader.setLegacy()
+		c.gcmWriter.setLegacy()
+		c.legacy = newLegacyStream(c.gcmReader, c.gcmWriter)
+		if l := c.lifetimeConfig(); l != nil && (l.IdleTimeout > 0 || l.MaxLifetime > 0) {
+			go c.watchLifetime(l.IdleTimeout, l.MaxLifetime)
+		}
+		return nil
+	}
+	codec := newCodec(c.compress)
+	c.gcmReader.codec = codec
+	c.gcmWriter.setCodec(codec)
+	if p := c.parallel(); p > 1 {
+		c.gcmReader.setParallel(p)
+		c.gcmWriter.setParallel(p)
+	}
+
+	c.gcmReader.Handle(FramePing, c.handlePing)
+	c.gcmReader.Handle(FramePong, c.handlePong)
+	c.gcmReader.Handle(FrameKeepAlive, handleKeepAlive)
+	c.gcmReader.Handle(FrameGoAway, c.handleGoAway)
+	c.gcmReader.Handle(FrameClose, c.handleClose)
+	for typ, h := range c.frameHandlers {
+		c.gcmReader.Handle(typ, h)
+	}
+
+	if k := c.keepAliveConfig(); k != nil && k.KeepAlive > 0 {
+		go c.keepAlive(k.KeepAlive, k.keepAliveTimeout())
+	}
+	if l := c.lifetimeConfig(); l != nil && (l.IdleTimeout > 0 || l.MaxLifetime > 0) {
+		go c.watchLifetime(l.IdleTimeout, l.MaxLifetime)
+	}
 	return nil
 }
 
@@ -131,28 +321,182 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 	if err := c.Handshake(); err != nil {
 		return 0, err
 	}
-	if c.err != nil {
-		return 0, c.err
+	c.in.Lock()
+	defer c.in.Unlock()
+	if c.closed.Load() {
+		return 0, io.ErrClosedPipe
+	}
+	c.readSince.Store(time.Now().UnixNano())
+	defer c.readSince.Store(0)
+	if c.legacy != nil {
+		n, err = c.legacy.Read(b)
+	} else {
+		n, err = c.gcmReader.Read(b)
 	}
-	n, err = c.snappyReader.Read(b)
 	atomic.AddInt64(&c.rn, int64(n))
-	return
+	return n, c.wrapErr(err)
 }
 
 func (c *Conn) Write(b []byte) (n int, err error) {
 	if err := c.Handshake(); err != nil {
 		return 0, err
 	}
-	if c.err != nil {
-		return 0, c.err
+	c.out.Lock()
+	defer c.out.Unlock()
+	if c.closed.Load() {
+		return 0, io.ErrClosedPipe
+	}
+	if c.writeClosed {
+		return 0, errShutdown
+	}
+	if cfg := c.bufferConfig(); cfg != nil && cfg.WriteBuffered {
+		n, err = c.writeBuffered(cfg, b)
+	} else {
+		n, err = c.writeData(b)
 	}
-	n, err = c.snappyWriter.Write(b)
 	atomic.AddInt64(&c.wn, int64(n))
-	return
+	c.flushPong()
+	return n, c.wrapErr(err)
+}
+
+// ReadFrom 实现 io.ReaderFrom, 每次从 r 读取一批数据后加密发送, 直到 r 返回 io.EOF
+// 一次读取填满一帧时继续读取下一帧并合并发送, 否则立即发送
+// 读取 r 时不持有写锁, 阻塞的 r 不会拖住 pong、保活帧、GoAway 和 Close
+func (c *Conn) ReadFrom(r io.Reader) (n int64, err error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.out.Lock()
+	if err = c.writable(); err == nil {
+		err = c.flush()
+	}
+	c.out.Unlock()
+	if err != nil {
+		return 0, c.wrapErr(err)
+	}
+
+	buf := mcache.Malloc(max(1, gcmBatchSize/c.frameSize) * c.frameSize)
+	defer mcache.Free(buf)
+	for {
+		var rerr error
+		pos := 0
+		for pos+c.frameSize <= len(buf) {
+			var m int
+			m, rerr = r.Read(buf[pos : pos+c.frameSize])
+			pos += m
+			if rerr != nil || m < c.frameSize {
+				break
+			}
+		}
+		if pos > 0 {
+			m, err := c.writeBatch(buf[:pos])
+			n += int64(m)
+			if err != nil {
+				return n, err
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// writeBatch 持有写锁发送 ReadFrom 读取的一批数据
+func (c *Conn) writeBatch(b []byte) (n int, err error) {
+	c.out.Lock()
+	defer c.out.Unlock()
+	if err = c.writable(); err != nil {
+		return 0, err
+	}
+	n, err = c.writeData(b)
+	atomic.AddInt64(&c.wn, int64(n))
+	c.flushPong()
+	return n, c.wrapErr(err)
+}
+
+// writable 检查连接是否可以写入, 调用方需持有写锁
+func (c *Conn) writable() error {
+	if c.closed.Load() {
+		return io.ErrClosedPipe
+	}
+	if c.writeClosed {
+		return errShutdown
+	}
+	return nil
+}
+
+// WriteTo 实现 io.WriterTo, 将解密后的数据直接写入 w, 直到对端关闭写方向
+func (c *Conn) WriteTo(w io.Writer) (n int64, err error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.in.Lock()
+	defer c.in.Unlock()
+	if c.closed.Load() {
+		return 0, io.ErrClosedPipe
+	}
+	c.readSince.Store(time.Now().UnixNano())
+	defer c.readSince.Store(0)
+	if c.legacy != nil {
+		n, err = io.Copy(w, c.legacy)
+	} else {
+		n, err = c.gcmReader.WriteTo(w)
+	}
+	atomic.AddInt64(&c.rn, n)
+	return n, c.wrapErr(err)
+}
+
+// WriteSensitive 写入不压缩的数据, 用于与攻击者可控数据一起发送的密钥、令牌等敏感数据
+// 避免压缩长度泄露内容 (CRIME), 缓冲模式下会先发送缓冲区中的数据
+func (c *Conn) WriteSensitive(b []byte) (n int, err error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.out.Lock()
+	defer c.out.Unlock()
+	if c.closed.Load() {
+		return 0, io.ErrClosedPipe
+	}
+	if c.writeClosed {
+		return 0, errShutdown
+	}
+	if c.legacy != nil {
+		return 0, errLegacy
+	}
+	if err = c.flush(); err == nil {
+		c.syncBatch()
+		n, err = c.gcmWriter.write(b, false)
+	}
+	atomic.AddInt64(&c.wn, int64(n))
+	c.flushPong()
+	return n, c.wrapErr(err)
+}
+
+// writeData 发送应用数据, 调用方需持有写锁
+func (c *Conn) writeData(b []byte) (int, error) {
+	c.syncBatch()
+	if c.legacy != nil {
+		return c.legacy.Write(b)
+	}
+	return c.gcmWriter.Write(b)
+}
+
+// syncBatch 合并写入不超过限速器的突发值, 避免一次写入等待过久
+// 限速器会被 SetLimits 和配额限速修改, 每次写入前重新计算, 调用方需持有写锁
+func (c *Conn) syncBatch() {
+	c.gcmWriter.maxBatch = c.stat.wL.burst()
+}
+
+// LimitWait 返回读写因限速累计等待的时间
+func (c *Conn) LimitWait() (read, write time.Duration) {
+	return c.stat.Waited()
 }
 
 func (c *Conn) Stat() (inR, inW, outR, outW int64) {
-	if c.stat == nil {
+	if !c.handshakeComplete.Load() {
 		return
 	}
 	inR = atomic.LoadInt64(&c.rn)
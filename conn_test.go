@@ -4,8 +4,13 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
 	"io"
+	"net"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -28,11 +33,7 @@ func TestConn(t *testing.T) {
 	t.Run("successful", func(t *testing.T) {
 		wbuf := &MockConn{}
 		wbuf.writer = bytes.NewBuffer(nil)
-		wconn := &Conn{
-			conn:         wbuf,
-			clientConfig: clientConfig,
-		}
-		wconn.handshakeFn = wconn.clientHandshake
+		wconn := Client(wbuf, clientConfig)
 		wbuf.On("SetWriteDeadline", mock.Anything).Return(nil)
 		wbuf.On("Close").Return(nil)
 		err := wconn.Handshake()
@@ -41,13 +42,11 @@ func TestConn(t *testing.T) {
 
 		rbuf := &MockConn{}
 		rbuf.reader = bytes.NewBuffer(wbuf.writer.(*bytes.Buffer).Bytes())
-		rconn := &Conn{
-			conn:      rbuf,
-			serverCtx: serverCtx,
-		}
-		rconn.handshakeFn = rconn.serverHandshake
+		rconn := Server(rbuf, serverCtx)
 		rbuf.On("SetReadDeadline", mock.Anything).Return(nil)
+		rbuf.On("SetWriteDeadline", mock.Anything).Return(nil)
 		rbuf.On("Close").Return(nil)
+		rbuf.writer = bytes.NewBuffer(nil)
 		err = rconn.Handshake()
 		require.NoError(t, err)
 		defer rconn.Close()
@@ -89,3 +88,439 @@ func TestConn(t *testing.T) {
 		assert.Equal(t, longBuf, buf)
 	})
 }
+
+func TestConnConcurrentClose(t *testing.T) {
+	waitErr := func(t *testing.T, ch <-chan error) error {
+		t.Helper()
+		select {
+		case err := <-ch:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("operation not unblocked by Close")
+		}
+		return nil
+	}
+
+	t.Run("close during blocked read", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := server.Read(make([]byte, 64))
+			errCh <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		require.NoError(t, server.Close())
+		assert.Error(t, waitErr(t, errCh))
+
+		_, err = server.Read(make([]byte, 64))
+		assert.ErrorIs(t, err, io.ErrClosedPipe)
+	})
+
+	t.Run("close during blocked write", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		client, server, err := newTestPipe(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer server.Close()
+
+		// net.Pipe 没有缓冲, 对端不读时写入会一直阻塞
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := client.Write(make([]byte, 64*1024))
+			errCh <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		require.NoError(t, client.Close())
+		assert.Error(t, waitErr(t, errCh))
+
+		_, err = client.Write([]byte("hello"))
+		assert.ErrorIs(t, err, io.ErrClosedPipe)
+	})
+
+	t.Run("close during pending handshake", func(t *testing.T) {
+		_, serverCtx := newTestConfig(t)
+		c, s := net.Pipe()
+		defer c.Close()
+		server := Server(s, serverCtx)
+
+		errCh := make(chan error, 3)
+		go func() {
+			errCh <- server.Handshake()
+		}()
+		go func() {
+			_, err := server.Read(make([]byte, 64))
+			errCh <- err
+		}()
+		go func() {
+			_, err := server.Write([]byte("hello"))
+			errCh <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		require.NoError(t, server.Close())
+		for range 3 {
+			assert.Error(t, waitErr(t, errCh))
+		}
+		assert.False(t, server.ConnectionState().HandshakeComplete)
+	})
+
+	t.Run("close before handshake", func(t *testing.T) {
+		clientConfig, _ := newTestConfig(t)
+		c, s := net.Pipe()
+		defer s.Close()
+		client := Client(c, clientConfig)
+		require.NoError(t, client.Close())
+		assert.ErrorIs(t, client.Handshake(), io.ErrClosedPipe)
+		assert.NoError(t, client.Close())
+	})
+
+	t.Run("concurrent read write close", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		echo := func(c *Conn) {
+			defer wg.Done()
+			buf := make([]byte, 1024)
+			for {
+				n, err := c.Read(buf)
+				if err != nil {
+					return
+				}
+				if _, err = c.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+		}
+		wg.Add(2)
+		go echo(server)
+		go func() {
+			defer wg.Done()
+			for {
+				if _, err := client.Write([]byte("hello")); err != nil {
+					return
+				}
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 1024)
+			for {
+				if _, err := client.Read(buf); err != nil {
+					return
+				}
+				client.Stat()
+				client.ConnectionState()
+			}
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		closeWg := sync.WaitGroup{}
+		for _, c := range []*Conn{client, server, client} {
+			closeWg.Add(1)
+			go func() {
+				defer closeWg.Done()
+				c.Close()
+			}()
+		}
+		closeWg.Wait()
+		wg.Wait()
+	})
+}
+
+func TestConnCloseWrite(t *testing.T) {
+	clientConfig, serverCtx := newTestConfig(t)
+
+	c := Client(&MockConn{}, clientConfig)
+	assert.ErrorContains(t, c.CloseWrite(), "before handshake complete")
+
+	client, server, err := newTestConns(t, clientConfig, serverCtx)
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+
+	// 客户端发送请求后半关闭, 服务端读到 EOF 后回复
+	go func() {
+		client.Write([]byte("request"))
+		client.CloseWrite()
+	}()
+	req, err := io.ReadAll(server)
+	require.NoError(t, err)
+	assert.Equal(t, "request", string(req))
+
+	_, err = server.Write([]byte("response"))
+	require.NoError(t, err)
+	require.NoError(t, server.CloseWrite())
+
+	resp, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "response", string(resp))
+
+	_, err = client.Write([]byte("more"))
+	assert.Error(t, err)
+	assert.NoError(t, client.CloseWrite())
+}
+
+func TestConnTruncated(t *testing.T) {
+	clientConfig, serverCtx := newTestConfig(t)
+
+	t.Run("close sends eof", func(t *testing.T) {
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer server.Close()
+
+		_, err = client.Write([]byte("bye"))
+		require.NoError(t, err)
+		require.NoError(t, client.Close())
+
+		data, err := io.ReadAll(server)
+		require.NoError(t, err)
+		assert.Equal(t, "bye", string(data))
+	})
+
+	t.Run("tcp closed without eof", func(t *testing.T) {
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer server.Close()
+		defer client.Close()
+
+		_, err = client.Write([]byte("bye"))
+		require.NoError(t, err)
+		require.NoError(t, client.NetConn().Close())
+
+		data, err := io.ReadAll(server)
+		assert.ErrorIs(t, err, ErrTruncated)
+		assert.Equal(t, "bye", string(data))
+	})
+}
+
+func TestConnReadFromWriteTo(t *testing.T) {
+	clientConfig, serverCtx := newTestConfig(t)
+	client, server, err := newTestConns(t, clientConfig, serverCtx)
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+
+	data := make([]byte, 1024*1024+123)
+	rand.Read(data)
+
+	errCh := make(chan error, 1)
+	go func() {
+		// 小块读取的数据源, 每次读取不足一帧时立即发送
+		n, err := client.ReadFrom(io.MultiReader(bytes.NewReader(data[:100]), bytes.NewReader(data[100:])))
+		if err == nil && n != int64(len(data)) {
+			err = io.ErrShortWrite
+		}
+		if err == nil {
+			err = client.CloseWrite()
+		}
+		errCh <- err
+	}()
+
+	// 先读一部分, 剩余数据由 WriteTo 输出
+	head := make([]byte, 10)
+	_, err = io.ReadFull(server, head)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	n, err := server.WriteTo(&buf)
+	require.NoError(t, err)
+	require.NoError(t, <-errCh)
+	assert.Equal(t, int64(len(data)-10), n)
+	assert.Equal(t, data, append(head, buf.Bytes()...))
+
+	// 对端已关闭写方向
+	n, err = server.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+
+	_, err = client.ReadFrom(bytes.NewReader(data))
+	assert.ErrorIs(t, err, errShutdown)
+}
+
+func TestConnReadFromBlocked(t *testing.T) {
+	clientConfig, serverCtx := newTestConfig(t)
+	client, server, err := newTestConns(t, clientConfig, serverCtx)
+	require.NoError(t, err)
+	defer server.Close()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go client.ReadFrom(pr)
+	_, err = pw.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(server, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	// 数据源阻塞时不持有写锁, Close 仍然可以发送 EOF 帧
+	require.NoError(t, client.Close())
+	n, err := server.Read(buf)
+	assert.Zero(t, n)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func BenchmarkConnCopy(b *testing.B) {
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+
+	run := func(b *testing.B, copyFn func(dst io.Writer, src io.Reader) (int64, error)) {
+		clientConfig, serverCtx := newTestConfig(b)
+		clientConfig.Compression = []string{CompressNone}
+		client, server, err := newTestConns(b, clientConfig, serverCtx)
+		require.NoError(b, err)
+		defer client.Close()
+		defer server.Close()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			copyFn(io.Discard, server)
+		}()
+
+		b.SetBytes(int64(len(data)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := copyFn(client, bytes.NewReader(data)); err != nil {
+				b.Fatal(err)
+			}
+		}
+		client.CloseWrite()
+		<-done
+	}
+
+	b.Run("ReadFrom/WriteTo", func(b *testing.B) {
+		run(b, func(dst io.Writer, src io.Reader) (int64, error) {
+			if c, ok := dst.(*Conn); ok {
+				return c.ReadFrom(src)
+			}
+			return src.(*Conn).WriteTo(dst)
+		})
+	})
+
+	b.Run("generic", func(b *testing.B) {
+		run(b, func(dst io.Writer, src io.Reader) (int64, error) {
+			// 隐藏 ReaderFrom 和 WriterTo, 使用 io.Copy 的通用缓冲循环
+			return io.Copy(struct{ io.Writer }{dst}, struct{ io.Reader }{src})
+		})
+	})
+}
+
+func BenchmarkConnWrite(b *testing.B) {
+	for _, frameSize := range []int{4 * 1024, 64 * 1024} {
+		b.Run(fmt.Sprintf("%dK", frameSize/1024), func(b *testing.B) {
+			clientConfig, serverCtx := newTestConfig(b)
+			clientConfig.MaxFrameSize = frameSize
+			serverCtx.MaxFrameSize = frameSize
+			client, server, err := newTestConns(b, clientConfig, serverCtx)
+			require.NoError(b, err)
+			defer client.Close()
+			defer server.Close()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				io.Copy(io.Discard, server)
+			}()
+
+			data := make([]byte, 1024*1024)
+			rand.Read(data)
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			client.Close()
+			<-done
+		})
+	}
+}
+
+func TestConnIdleBuffers(t *testing.T) {
+	clientConfig, serverCtx := newTestConfig(t)
+	client, server, err := newTestConns(t, clientConfig, serverCtx)
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+
+	var frames []string
+	require.NoError(t, server.HandleFrame(FrameUserMin, func(payload []byte) error {
+		frames = append(frames, string(payload))
+		return nil
+	}))
+
+	// 一次完整的收发, 包括自定义帧
+	data := make([]byte, 3*gcmPacketSize)
+	rand.Read(data)
+	require.NoError(t, client.WriteFrame(FrameUserMin, []byte("ping")))
+	_, err = client.Write(data)
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(server, buf)
+	require.NoError(t, err)
+	assert.Equal(t, data, buf)
+	assert.Equal(t, []string{"ping"}, frames)
+	_, err = server.Write([]byte("pong"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(client, buf[:4])
+	require.NoError(t, err)
+
+	// 空闲后不持有任何缓冲区
+	for _, c := range []*Conn{client, server} {
+		assert.Nil(t, c.gcmReader.buf)
+		assert.Nil(t, c.gcmReader.dbuf)
+		assert.Nil(t, c.gcmWriter.buf)
+		assert.Nil(t, c.gcmWriter.cbuf)
+	}
+}
+
+// BenchmarkConnMemory 统计空闲连接占用的内存, 每个连接有一个阻塞在 Read 的协程
+func BenchmarkConnMemory(b *testing.B) {
+	const conns = 200
+	clientConfig, serverCtx := newTestConfig(b)
+
+	heapInuse := func() uint64 {
+		var m runtime.MemStats
+		runtime.GC()
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		return m.HeapInuse
+	}
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		before := heapInuse()
+		var wg sync.WaitGroup
+		pairs := make([]*Conn, 0, 2*conns)
+		for j := 0; j < conns; j++ {
+			client, server, err := newTestConns(b, clientConfig, serverCtx)
+			require.NoError(b, err)
+			pairs = append(pairs, client, server)
+
+			// 收发一次数据后进入空闲
+			_, err = client.Write([]byte("hello"))
+			require.NoError(b, err)
+			_, err = io.ReadFull(server, make([]byte, 5))
+			require.NoError(b, err)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				io.Copy(io.Discard, server)
+			}()
+		}
+		after := heapInuse()
+		b.ReportMetric(float64(after-before)/conns, "B/conn")
+
+		for _, c := range pairs {
+			c.Close()
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,147 @@
+package stcp
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrTooManyConns 表示连接数超过 MaxConns、MaxConnsPerIP、MaxConnsPerKey 或 MaxHandshakes
+var ErrTooManyConns = errors.New("stcp: too many connections")
+
+// connTracker 服务端的连接数统计
+// 总数、来源 IP 和握手数在监听器 Accept 时检查, 拒绝的连接直接关闭, 不做任何握手计算
+// 客户端公钥在握手读取公钥后、ECDH 之前检查, 认证通过后占用名额
+type connTracker struct {
+	mu         sync.Mutex
+	total      int
+	handshakes int
+	perIP      map[string]int
+	perKey     map[string]int
+}
+
+// connSlot 监听器接受的连接占用的名额, 关闭时释放
+type connSlot struct {
+	t           *connTracker
+	ip          string
+	handshaking bool
+	released    bool
+}
+
+// admit 检查总连接数、来源 IP 的连接数和进行中的握手数, 超过限制时返回 ErrTooManyConns
+func (ctx *ServerContext) admit(addr net.Addr) (*connSlot, error) {
+	t := &ctx.conns
+	ip := addrIP(addr)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ctx.MaxConns > 0 && t.total >= ctx.MaxConns {
+		return nil, ErrTooManyConns
+	}
+	if ctx.MaxHandshakes > 0 && t.handshakes >= ctx.MaxHandshakes {
+		return nil, ErrTooManyConns
+	}
+	if ctx.MaxConnsPerIP > 0 && t.perIP[ip] >= ctx.MaxConnsPerIP {
+		return nil, ErrTooManyConns
+	}
+	if t.perIP == nil {
+		t.perIP = make(map[string]int)
+	}
+	t.total++
+	t.handshakes++
+	t.perIP[ip]++
+	return &connSlot{t: t, ip: ip, handshaking: true}, nil
+}
+
+// handshakeDone 握手结束, 不再占用握手名额
+func (s *connSlot) handshakeDone() {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.endHandshake()
+}
+
+// endHandshake 调用方需持有 s.t.mu
+func (s *connSlot) endHandshake() {
+	if s.handshaking {
+		s.handshaking = false
+		s.t.handshakes--
+	}
+}
+
+func (s *connSlot) release() {
+	t := s.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	s.endHandshake()
+	t.total--
+	if t.perIP[s.ip]--; t.perIP[s.ip] <= 0 {
+		delete(t.perIP, s.ip)
+	}
+}
+
+// maxConnsPerKey 返回客户端公钥的最大连接数, KeyPolicy.MaxConns 优先
+func (ctx *ServerContext) maxConnsPerKey(peerKey []byte) int {
+	if n := ctx.keyPolicy(peerKey).MaxConns; n > 0 {
+		return n
+	}
+	return ctx.MaxConnsPerKey
+}
+
+// keyFull 客户端公钥的连接数已达上限, 在 ECDH 之前快速拒绝
+func (ctx *ServerContext) keyFull(peerKey []byte) bool {
+	limit := ctx.maxConnsPerKey(peerKey)
+	if limit <= 0 {
+		return false
+	}
+	t := &ctx.conns
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.perKey[string(peerKey)] >= limit
+}
+
+// acquireKey 认证通过后占用客户端公钥的连接名额, 连接关闭时需要调用 release
+func (ctx *ServerContext) acquireKey(peerKey []byte) (release func(), err error) {
+	limit := ctx.maxConnsPerKey(peerKey)
+	t := &ctx.conns
+	id := string(peerKey)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if limit > 0 && t.perKey[id] >= limit {
+		return nil, ErrTooManyConns
+	}
+	if t.perKey == nil {
+		t.perKey = make(map[string]int)
+	}
+	t.perKey[id]++
+	release = func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.perKey[id]--; t.perKey[id] <= 0 {
+			delete(t.perKey, id)
+		}
+	}
+	return release, nil
+}
+
+// addrIP 返回地址中的 IP, 无法解析时返回完整地址
+func addrIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	s := addr.String()
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return s
+}
@@ -0,0 +1,114 @@
+package stcp
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnLimit(t *testing.T) {
+	// newServer 返回监听器和接受连接的通道
+	newServer := func(t *testing.T, serverCtx *ServerContext) (net.Listener, chan net.Conn) {
+		ln, err := Listen("tcp", "127.0.0.1:0", serverCtx)
+		require.NoError(t, err)
+		t.Cleanup(func() { ln.Close() })
+		accepted := make(chan net.Conn, 8)
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- c
+			}
+		}()
+		return ln, accepted
+	}
+
+	dial := func(t *testing.T, ln net.Listener) net.Conn {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	// rejected 被拒绝的连接会被服务端直接关闭
+	rejected := func(t *testing.T, c net.Conn) {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := c.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	}
+
+	t.Run("max conns", func(t *testing.T) {
+		_, serverCtx := newTestConfig(t)
+		serverCtx.MaxConns = 1
+		ln, accepted := newServer(t, serverCtx)
+
+		dial(t, ln)
+		s1 := <-accepted
+		rejected(t, dial(t, ln))
+
+		// 关闭后释放名额
+		s1.Close()
+		dial(t, ln)
+		select {
+		case s := <-accepted:
+			s.Close()
+		case <-time.After(time.Second):
+			t.Fatal("accept timeout")
+		}
+	})
+
+	t.Run("max conns per ip", func(t *testing.T) {
+		_, serverCtx := newTestConfig(t)
+		serverCtx.MaxConnsPerIP = 2
+		ln, accepted := newServer(t, serverCtx)
+
+		dial(t, ln)
+		dial(t, ln)
+		<-accepted
+		<-accepted
+		rejected(t, dial(t, ln))
+	})
+
+	t.Run("max handshakes", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		serverCtx.MaxHandshakes = 1
+		ln, accepted := newServer(t, serverCtx)
+
+		c1 := Client(dial(t, ln), clientConfig)
+		s1 := (<-accepted).(*Conn)
+		rejected(t, dial(t, ln))
+
+		// 握手完成后不再占用握手名额
+		go c1.Handshake()
+		require.NoError(t, s1.Handshake())
+		dial(t, ln)
+		select {
+		case <-accepted:
+		case <-time.After(time.Second):
+			t.Fatal("accept timeout")
+		}
+	})
+
+	t.Run("max conns per key", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		serverCtx.MaxConnsPerKey = 1
+
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		_, _, err = newTestConns(t, clientConfig, serverCtx)
+		assert.ErrorIs(t, err, ErrTooManyConns)
+
+		client.Close()
+		server.Close()
+		client, server, err = newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		client.Close()
+		server.Close()
+	})
+}
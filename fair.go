@@ -0,0 +1,162 @@
+package stcp
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// 公平调度
+// 多个连接共享的限速器饱和时按权重分配带宽 (start-time fair queueing)
+// 请求的虚拟开始时间取全局虚拟时间和本连接上一请求虚拟结束时间的较大值, 按开始时间依次放行
+// 同一时间只有一个请求在共享限速器上等待, 新连接的请求不会排在大流量连接的积压之后
+// 每个连接同一时间只有一个请求, 刚等待结束的连接在 fairIdle 内再次请求时仍可按开始时间优先
+
+// fairIdle 等待刚结束的连接再次请求的时间
+const fairIdle = 2 * time.Millisecond
+
+// fairLimiter 按权重公平调度的共享限速器
+type fairLimiter struct {
+	l *rate.Limiter
+
+	mu    sync.Mutex
+	queue fairQueue
+	vtime float64
+	seq   uint64
+	busy  bool // 已放行的请求正在等待限速器, 或者在等待 expect 再次请求
+	// 等待再次请求的连接, 超时后放行队列中的请求
+	expect  *fairFlow
+	idle    *time.Timer
+	idleSeq uint64
+}
+
+func newFairLimiter(l *rate.Limiter) *fairLimiter {
+	return &fairLimiter{l: l}
+}
+
+// flow 返回一个权重为 weight 的连接, weight 不大于 0 时取 1
+func (q *fairLimiter) flow(weight int) *fairFlow {
+	return &fairFlow{q: q, weight: float64(max(weight, 1))}
+}
+
+// fairFlow 共享限速器上的一个连接
+type fairFlow struct {
+	q      *fairLimiter
+	weight float64
+	finish float64 // 上一请求的虚拟结束时间, 由 q.mu 保护
+}
+
+type fairRequest struct {
+	start float64
+	seq   uint64
+	index int // 在队列中的位置, 放行或取消后为 -1
+	ready chan struct{}
+}
+
+// push 请求 n 字节, ready 关闭后轮到该请求, 之后需要调用 release
+func (q *fairLimiter) push(f *fairFlow, n int) *fairRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	req := &fairRequest{
+		start: max(q.vtime, f.finish),
+		seq:   q.seq,
+		ready: make(chan struct{}),
+	}
+	f.finish = req.start + float64(n)/f.weight
+	q.seq++
+	heap.Push(&q.queue, req)
+	if q.expect == f {
+		q.expect = nil
+		q.idle.Stop()
+		q.busy = false
+	}
+	q.next()
+	return req
+}
+
+// cancel 取消等待中的请求, 已经放行时等同于 release
+func (q *fairLimiter) cancel(req *fairRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if req.index >= 0 {
+		heap.Remove(&q.queue, req.index)
+		return
+	}
+	q.busy = false
+	q.next()
+}
+
+// release 放行的请求等待结束, 放行下一个请求
+// f 的下一个请求开始时间早于队列中的请求时, 先等待 f 再次请求
+func (q *fairLimiter) release(f *fairFlow) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.queue) > 0 && f.finish < q.queue[0].start {
+		q.expect = f
+		q.idleSeq++
+		seq := q.idleSeq
+		q.idle = time.AfterFunc(fairIdle, func() { q.expire(seq) })
+		return
+	}
+	q.busy = false
+	q.next()
+}
+
+// expire 等待的连接没有在 fairIdle 内再次请求, 放行队列中的请求
+func (q *fairLimiter) expire(seq uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.expect == nil || q.idleSeq != seq {
+		return
+	}
+	q.expect = nil
+	q.busy = false
+	q.next()
+}
+
+// next 放行开始时间最小的请求, 调用方需持有 q.mu
+func (q *fairLimiter) next() {
+	if q.busy || len(q.queue) == 0 {
+		return
+	}
+	req := heap.Pop(&q.queue).(*fairRequest)
+	q.busy = true
+	q.vtime = req.start
+	close(req.ready)
+}
+
+// fairQueue 按虚拟开始时间排序的最小堆, 开始时间相同时先到先出
+type fairQueue []*fairRequest
+
+func (h fairQueue) Len() int { return len(h) }
+
+func (h fairQueue) Less(i, j int) bool {
+	if h[i].start != h[j].start {
+		return h[i].start < h[j].start
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h fairQueue) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *fairQueue) Push(x any) {
+	req := x.(*fairRequest)
+	req.index = len(*h)
+	*h = append(*h, req)
+}
+
+func (h *fairQueue) Pop() any {
+	old := *h
+	n := len(old)
+	req := old[n-1]
+	old[n-1] = nil
+	req.index = -1
+	*h = old[:n-1]
+	return req
+}
@@ -0,0 +1,113 @@
+package stcp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+// fairReady 返回请求是否已经放行
+func fairReady(req *fairRequest) bool {
+	select {
+	case <-req.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFairShare(t *testing.T) {
+	// 放行顺序只由 push/release 决定, 不需要真实的限速
+	newQueue := func() *fairLimiter {
+		return newFairLimiter(rate.NewLimiter(rate.Inf, 0))
+	}
+
+	t.Run("weights", func(t *testing.T) {
+		q := newQueue()
+		heavy, light := q.flow(3), q.flow(1)
+		flows := []*fairFlow{heavy, light}
+
+		// 两个连接一直有积压, 每个请求放行后立即发起下一个请求
+		const n = 4 * 1024
+		reqs := []*fairRequest{q.push(heavy, n), q.push(light, n)}
+		var bytes [2]int
+		for range 400 {
+			granted := -1
+			for i, req := range reqs {
+				if fairReady(req) {
+					require.Equal(t, -1, granted, "only one request may be granted")
+					granted = i
+				}
+			}
+			require.NotEqual(t, -1, granted)
+			bytes[granted] += n
+			q.release(flows[granted])
+			reqs[granted] = q.push(flows[granted], n)
+		}
+		ratio := float64(bytes[0]) / float64(bytes[1])
+		assert.InDelta(t, 3, ratio, 0.1)
+	})
+
+	t.Run("new flow", func(t *testing.T) {
+		q := newQueue()
+		bulk, light := q.flow(1), q.flow(1)
+
+		// 大流量连接已经连续发送了很多请求
+		req := q.push(bulk, 64*1024)
+		for range 100 {
+			require.True(t, fairReady(req))
+			q.release(bulk)
+			req = q.push(bulk, 64*1024)
+		}
+		require.True(t, fairReady(req))
+
+		// 新连接只需等待正在进行的一个请求
+		lreq := q.push(light, 1024)
+		assert.False(t, fairReady(lreq))
+		q.release(bulk)
+		breq := q.push(bulk, 64*1024)
+		assert.True(t, fairReady(lreq))
+		assert.False(t, fairReady(breq))
+
+		// 新连接的下一个请求仍然优先
+		q.release(light)
+		lreq = q.push(light, 1024)
+		assert.True(t, fairReady(lreq))
+		assert.False(t, fairReady(breq))
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		q := newQueue()
+		a, b, c := q.flow(1), q.flow(1), q.flow(1)
+		ra := q.push(a, 1024)
+		rb := q.push(b, 1024)
+		rc := q.push(c, 1024)
+		require.True(t, fairReady(ra))
+
+		// 取消排队中的请求, 不影响其他请求
+		q.cancel(rb)
+		assert.Len(t, q.queue, 1)
+		// 取消已放行的请求等同于 release
+		q.cancel(ra)
+		assert.True(t, fairReady(rc))
+		assert.False(t, fairReady(rb))
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		q := newQueue()
+		a, b := q.flow(1), q.flow(1)
+		require.True(t, fairReady(q.push(b, 4096)))
+		ra := q.push(a, 1024)
+		q.release(b)
+		require.True(t, fairReady(ra))
+		rb := q.push(b, 4096)
+
+		// a 的下一个请求开始时间更早, 先等待 a 再次请求, 没有请求时超时后放行 b
+		q.release(a)
+		assert.False(t, fairReady(rb))
+		assert.Eventually(t, func() bool { return fairReady(rb) }, time.Second, fairIdle)
+	})
+}
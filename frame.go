@@ -0,0 +1,109 @@
+package stcp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FrameType 帧类型, 随帧头一起作为附加数据参与认证
+type FrameType uint8
+
+// 内置帧类型, FrameUserMin 之前的类型保留给协议本身
+const (
+	FrameData      FrameType = 0x00
+	FrameEOF       FrameType = 0x01
+	FramePing      FrameType = 0x02
+	FramePong      FrameType = 0x03
+	FrameKeepAlive FrameType = 0x04
+	// FrameCompressed 压缩后的数据帧
+	FrameCompressed FrameType = 0x05
+	// FrameGoAway 服务端即将关闭, 对端应尽快结束会话
+	FrameGoAway FrameType = 0x06
+	// FrameClose 关闭连接, 携带关闭原因
+	FrameClose FrameType = 0x07
+
+	// FrameUserMin 应用自定义帧类型的起始值
+	FrameUserMin FrameType = 0x80
+)
+
+// 附加数据中的方向标识
+const (
+	dirClient = 0x01 // 客户端到服务端
+	dirServer = 0x02 // 服务端到客户端
+)
+
+// FrameHandler 处理非数据帧, 在读协程中调用, payload 仅在调用期间有效
+// 返回错误时本次 Read 返回该错误
+type FrameHandler func(payload []byte) error
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameData:
+		return "data"
+	case FrameEOF:
+		return "eof"
+	case FramePing:
+		return "ping"
+	case FramePong:
+		return "pong"
+	case FrameKeepAlive:
+		return "keepalive"
+	case FrameCompressed:
+		return "compressed"
+	case FrameGoAway:
+		return "goaway"
+	case FrameClose:
+		return "close"
+	}
+	return fmt.Sprintf("frame(%d)", uint8(t))
+}
+
+// HandleFrame 注册自定义帧的处理函数, 可以在握手前调用
+// h 为 nil 时取消注册, 未注册的帧类型在读取时返回错误
+func (c *Conn) HandleFrame(typ FrameType, h FrameHandler) error {
+	if typ < FrameUserMin {
+		return fmt.Errorf("stcp: reserved frame type: %s", typ)
+	}
+	c.in.Lock()
+	defer c.in.Unlock()
+	if c.frameHandlers == nil {
+		c.frameHandlers = make(map[FrameType]FrameHandler)
+	}
+	if h == nil {
+		delete(c.frameHandlers, typ)
+	} else {
+		c.frameHandlers[typ] = h
+	}
+	if c.gcmReader != nil {
+		c.gcmReader.Handle(typ, h)
+	}
+	return nil
+}
+
+// WriteFrame 发送一个自定义帧, payload 不能超过单帧大小
+func (c *Conn) WriteFrame(typ FrameType, payload []byte) error {
+	if typ < FrameUserMin {
+		return fmt.Errorf("stcp: reserved frame type: %s", typ)
+	}
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	c.out.Lock()
+	defer c.out.Unlock()
+	if c.closed.Load() {
+		return io.ErrClosedPipe
+	}
+	if c.writeClosed {
+		return errShutdown
+	}
+	if len(payload) > c.frameSize {
+		return errors.New("stcp: frame payload too long")
+	}
+	// 先发送缓冲区中的数据, 保证与之前写入的数据顺序一致
+	if err := c.flush(); err != nil {
+		return c.wrapErr(err)
+	}
+	_, err := c.gcmWriter.writeFrame(typ, payload)
+	return c.wrapErr(err)
+}
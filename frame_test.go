@@ -0,0 +1,177 @@
+package stcp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecureFrame(t *testing.T) {
+	key := make([]byte, 32)
+	io.ReadFull(rand.Reader, key)
+	nonce := make([]byte, gcmNonceSize)
+	io.ReadFull(rand.Reader, nonce)
+
+	seal := func(dir byte, version uint8, write func(w *SecureWriter)) []byte {
+		aead, err := newAES256GCM(key)
+		require.NoError(t, err)
+		buf := bytes.NewBuffer(nil)
+		w := NewSecureWriter(&mockBuffer{writer: buf}, aead, nonce)
+		defer w.Close()
+		w.bind(dir, version)
+		write(w)
+		return buf.Bytes()
+	}
+	open := func(p []byte, dir byte, version uint8) *SecureReader {
+		aead, err := newAES256GCM(key)
+		require.NoError(t, err)
+		r := NewSecureReader(bytes.NewReader(p), aead, nonce)
+		r.bind(dir, version)
+		return r
+	}
+
+	t.Run("dispatch", func(t *testing.T) {
+		p := seal(dirClient, VersionV1, func(w *SecureWriter) {
+			require.NoError(t, w.WriteFrame(FrameUserMin, []byte("control")))
+			_, err := w.Write([]byte("data"))
+			require.NoError(t, err)
+		})
+
+		r := open(p, dirClient, VersionV1)
+		defer r.Close()
+		var got []byte
+		r.Handle(FrameUserMin, func(payload []byte) error {
+			got = append(got, payload...)
+			return nil
+		})
+		buf := make([]byte, 16)
+		n, err := r.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, "data", string(buf[:n]))
+		assert.Equal(t, "control", string(got))
+	})
+
+	t.Run("handler error", func(t *testing.T) {
+		p := seal(dirClient, VersionV1, func(w *SecureWriter) {
+			require.NoError(t, w.WriteFrame(FrameUserMin, nil))
+		})
+		r := open(p, dirClient, VersionV1)
+		defer r.Close()
+		r.Handle(FrameUserMin, func([]byte) error {
+			return io.ErrShortBuffer
+		})
+		_, err := r.Read(make([]byte, 16))
+		assert.ErrorIs(t, err, io.ErrShortBuffer)
+	})
+
+	t.Run("direction mismatch", func(t *testing.T) {
+		p := seal(dirClient, VersionV1, func(w *SecureWriter) {
+			_, err := w.Write([]byte("data"))
+			require.NoError(t, err)
+		})
+		r := open(p, dirServer, VersionV1)
+		defer r.Close()
+		_, err := r.Read(make([]byte, 16))
+		assert.ErrorContains(t, err, "cipher")
+	})
+
+	t.Run("version mismatch", func(t *testing.T) {
+		p := seal(dirClient, VersionV1, func(w *SecureWriter) {
+			_, err := w.Write([]byte("data"))
+			require.NoError(t, err)
+		})
+		r := open(p, dirClient, VersionV1+1)
+		defer r.Close()
+		_, err := r.Read(make([]byte, 16))
+		assert.ErrorContains(t, err, "cipher")
+	})
+
+	t.Run("invalid frame", func(t *testing.T) {
+		seal(dirClient, VersionV1, func(w *SecureWriter) {
+			assert.Error(t, w.WriteFrame(FrameData, nil))
+			assert.Error(t, w.WriteFrame(FrameEOF, nil))
+			assert.Error(t, w.WriteFrame(FrameUserMin, make([]byte, gcmPacketSize+1)))
+		})
+	})
+}
+
+func TestConnFrame(t *testing.T) {
+	clientConfig, serverCtx := newTestConfig(t)
+
+	c := Client(&MockConn{}, clientConfig)
+	assert.ErrorContains(t, c.HandleFrame(FramePing, func([]byte) error { return nil }), "reserved frame type")
+	assert.ErrorContains(t, c.WriteFrame(FrameEOF, nil), "reserved frame type")
+
+	client, server, err := newTestConns(t, clientConfig, serverCtx)
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+
+	var got []string
+	require.NoError(t, server.HandleFrame(FrameUserMin, func(payload []byte) error {
+		got = append(got, string(payload))
+		return nil
+	}))
+
+	require.NoError(t, client.WriteFrame(FrameUserMin, []byte("hello")))
+	_, err = client.Write([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, client.CloseWrite())
+
+	data, err := io.ReadAll(server)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	assert.Equal(t, []string{"hello"}, got)
+
+	// 未注册的自定义帧返回错误
+	require.NoError(t, server.WriteFrame(FrameUserMin+1, nil))
+	_, err = client.Read(make([]byte, 16))
+	assert.ErrorContains(t, err, "unknown frame type")
+}
+
+func TestConnFrameBuffered(t *testing.T) {
+	clientConfig, serverCtx := newTestConfig(t)
+	clientConfig.WriteBuffered = true
+	client, server, err := newTestConns(t, clientConfig, serverCtx)
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+
+	// 处理自定义帧时记录之前已经收到的数据
+	var data []byte
+	var got []string
+	require.NoError(t, server.HandleFrame(FrameUserMin, func(payload []byte) error {
+		got = append(got, string(data)+"|"+string(payload))
+		return nil
+	}))
+
+	_, err = client.Write([]byte("a"))
+	require.NoError(t, err)
+	require.NoError(t, client.WriteFrame(FrameUserMin, []byte("1")))
+	_, err = client.Write([]byte("b"))
+	require.NoError(t, err)
+	require.NoError(t, client.WriteFrame(FrameUserMin, []byte("2")))
+	require.NoError(t, client.CloseWrite())
+
+	buf := make([]byte, 16)
+	for {
+		n, err := server.Read(buf)
+		data = append(data, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+	assert.Equal(t, "ab", string(data))
+	assert.Equal(t, []string{"a|1", "ab|2"}, got)
+}
+
+func TestFrameType(t *testing.T) {
+	assert.Equal(t, "data", FrameData.String())
+	assert.Equal(t, "keepalive", FrameKeepAlive.String())
+	assert.Equal(t, "frame(128)", FrameUserMin.String())
+}
@@ -6,6 +6,8 @@ require (
 	github.com/bytedance/gopkg v0.1.2
 	github.com/golang/snappy v1.0.0
 	github.com/gorilla/websocket v1.5.3
+	github.com/klauspost/compress v1.18.0
+	github.com/pierrec/lz4/v4 v4.1.22
 	github.com/stretchr/testify v1.10.0
 	github.com/taodev/pkg v0.1.12
 	github.com/xtaci/smux v1.5.34
@@ -2,17 +2,31 @@ package stcp
 
 import (
 	"errors"
+	"io"
 	"time"
+
+	"github.com/taodev/pkg/util"
 )
 
 const (
-	VersionV1 = 0x01
+	// VersionLegacy 未升级的对端使用的原始协议, 见 legacy.go
+	VersionLegacy = 0x00
+	VersionV1     = 0x01
 )
 
 func (c *Conn) serverHandshake() (err error) {
 	if c.serverCtx == nil {
 		return errors.New("stcp: invalid server config")
 	}
+	if c.serverCtx.shuttingDown() {
+		return ErrServerClosed
+	}
+	if !c.serverCtx.allowed(c.conn) {
+		return ErrAddrNotAllowed
+	}
+	if c.serverCtx.banned(c.conn) {
+		return ErrBanned
+	}
 	if err = c.conn.SetReadDeadline(time.Now().Add(c.serverCtx.HandshakeTimeout)); err != nil {
 		return err
 	}
@@ -20,10 +34,25 @@ func (c *Conn) serverHandshake() (err error) {
 	if err != nil {
 		return err
 	}
+	// 公钥限制了来源网段
+	if !c.serverCtx.keyAllowed(info.peerKey, c.conn) {
+		return ErrAddrNotAllowed
+	}
 	if err = c.conn.SetReadDeadline(time.Time{}); err != nil {
 		return err
 	}
-	return c.init(info.newCrypto, info.key, info.nonce)
+	if len(info.reply) > 0 {
+		if err = c.conn.SetWriteDeadline(time.Now().Add(c.serverCtx.HandshakeTimeout)); err != nil {
+			return err
+		}
+		if _, err = util.WriteFull(c.conn, info.reply); err != nil {
+			return err
+		}
+		if err = c.conn.SetWriteDeadline(time.Time{}); err != nil {
+			return err
+		}
+	}
+	return c.init(info)
 }
 
 func (c *Conn) clientHandshake() (err error) {
@@ -40,14 +69,41 @@ func (c *Conn) clientHandshake() (err error) {
 	if err = c.conn.SetWriteDeadline(time.Time{}); err != nil {
 		return err
 	}
-	return c.init(info.newCrypto, info.key, info.nonce)
+	if info.wantReply {
+		if err = c.conn.SetReadDeadline(time.Now().Add(c.clientConfig.HandshakeTimeout)); err != nil {
+			return err
+		}
+		if err = readServerHello(c.conn, info, c.clientConfig); err != nil {
+			return err
+		}
+		if err = c.conn.SetReadDeadline(time.Time{}); err != nil {
+			return err
+		}
+	}
+	return c.init(info)
 }
 
 func (c *Conn) Handshake() error {
 	c.handshakeOnce.Do(func() {
-		if err := c.handshakeFn(); err != nil {
-			c.err = err
+		if c.closed.Load() {
+			c.handshakeErr = io.ErrClosedPipe
+			return
+		}
+		start := time.Now()
+		err := c.handshakeFn()
+		if c.slot != nil {
+			c.slot.handshakeDone()
+		}
+		if err != nil {
+			if c.serverCtx != nil {
+				c.serverCtx.handshakeFailed(c.conn, err)
+			}
+			c.handshakeErr = err
+			return
 		}
+		c.handshakeTime = time.Now()
+		c.handshakeDuration = c.handshakeTime.Sub(start)
+		c.handshakeComplete.Store(true)
 	})
-	return c.err
+	return c.handshakeErr
 }
@@ -1,6 +1,7 @@
 package stcp
 
 import (
+	"bytes"
 	"crypto/ecdh"
 	"crypto/hmac"
 	"crypto/sha256"
@@ -9,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"time"
 
 	"github.com/taodev/pkg/types"
@@ -41,10 +43,27 @@ const (
 	CryptoXChacha20Poly1305 = "xchacha20-poly1305"
 )
 
+// 对端造成的握手失败, 计入封禁, 见 countsAsFailure
+var (
+	errReplay  = errors.New("replay attack")
+	errSign    = errors.New("sign error")
+	errPeerKey = errors.New("invalid peer key")
+)
+
 type handshakeInfo struct {
-	newCrypto newAEAD
-	key       []byte
-	nonce     []byte
+	newCrypto  newAEAD
+	cryptoType string
+	key        []byte
+	nonce      []byte
+
+	version   uint8
+	peerKey   []byte
+	protocol  string
+	frameSize int
+	compress  uint8
+	// 客户端: 是否需要等待服务端 hello; 服务端: 需要回复的 hello
+	wantReply bool
+	reply     []byte
 }
 
 func clientHandshake(w io.Writer, config *ClientConfig) (hi *handshakeInfo, err error) {
@@ -102,6 +121,12 @@ func clientHandshake(w io.Writer, config *ClientConfig) (hi *handshakeInfo, err
 	if _, err = hmacWrite(h, buf[:idEndV1]); err != nil {
 		return nil, fmt.Errorf("hmac write error: %w", err)
 	}
+	// 签名中的标记表示握手包之后跟着 hello, 原始协议没有
+	if !config.Legacy {
+		if _, err = hmacWrite(h, []byte(helloSignLabel)); err != nil {
+			return nil, fmt.Errorf("hmac write error: %w", err)
+		}
+	}
 	copy(buf[signStartV1:signEndV1], h.Sum(nil))
 
 	// nonce
@@ -110,11 +135,100 @@ func clientHandshake(w io.Writer, config *ClientConfig) (hi *handshakeInfo, err
 		return nil, fmt.Errorf("nonce error: %w", err)
 	}
 
-	if _, err = util.WriteFull(w, buf[:]); err != nil {
+	if config.Legacy {
+		if _, err = util.WriteFull(w, buf[:]); err != nil {
+			return nil, fmt.Errorf("write error: %w", err)
+		}
+		return &handshakeInfo{
+			newCrypto:  newCrypto,
+			cryptoType: config.CryptoType,
+			key:        key,
+			nonce:      nonce,
+			version:    VersionLegacy,
+			peerKey:    bytes.Clone(config.ServerPub),
+			frameSize:  gcmPacketSize,
+			compress:   compressSnappy,
+		}, nil
+	}
+
+	// hello
+	frameSize, err := frameSizeOf(config.MaxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	compression := config.compression()
+	compress, err := compressIDs(compression)
+	if err != nil {
+		return nil, err
+	}
+	hello := &helloMsg{version: VersionV1, protocols: config.NextProtos, frameSize: frameSize, compress: compress}
+	// 使用默认参数时无需等待服务端回复, 服务端必须使用客户端首选的压缩算法
+	if len(hello.protocols) > 0 || frameSize != gcmPacketSize || !slices.Equal(compression, defaultCompression) {
+		hello.flags |= helloFlagWant
+	}
+	helloBytes, err := sealHello(key, helloClient, hello)
+	if err != nil {
+		return nil, fmt.Errorf("hello error: %w", err)
+	}
+
+	if _, err = util.WriteFull(w, append(buf[:], helloBytes...)); err != nil {
 		return nil, fmt.Errorf("write error: %w", err)
 	}
 
-	return &handshakeInfo{newCrypto: newCrypto, key: key, nonce: nonce}, nil
+	return &handshakeInfo{
+		newCrypto:  newCrypto,
+		cryptoType: config.CryptoType,
+		key:        key,
+		nonce:      nonce,
+		version:    hello.version,
+		peerKey:    bytes.Clone(config.ServerPub),
+		frameSize:  gcmPacketSize,
+		compress:   compress[0],
+		wantReply:  hello.flags&helloFlagWant != 0,
+	}, nil
+}
+
+// readServerHello 读取服务端回复的 hello, 完成协议协商
+func readServerHello(r io.Reader, hi *handshakeInfo, config *ClientConfig) (err error) {
+	hello, err := openHello(r, hi.key, helloServer)
+	if err != nil {
+		return fmt.Errorf("hello error: %w", err)
+	}
+	if hello.version != hi.version {
+		return fmt.Errorf("unsupported version: %d", hello.version)
+	}
+	if len(hello.protocols) > 1 {
+		return errors.New("server selected multiple protocols")
+	}
+	if len(hello.protocols) == 1 {
+		if !slices.Contains(config.NextProtos, hello.protocols[0]) {
+			return fmt.Errorf("server selected unadvertised protocol: %q", hello.protocols[0])
+		}
+		hi.protocol = hello.protocols[0]
+	}
+	// 未声明时服务端使用默认值
+	if hello.frameSize != 0 {
+		offer, err := frameSizeOf(config.MaxFrameSize)
+		if err != nil {
+			return err
+		}
+		if hello.frameSize < gcmPacketSize || hello.frameSize > offer {
+			return fmt.Errorf("server selected invalid frame size: %d", hello.frameSize)
+		}
+		hi.frameSize = int(hello.frameSize)
+	}
+	if len(hello.compress) > 0 {
+		compress := hello.compress[0]
+		offer, err := compressIDs(config.compression())
+		if err != nil {
+			return err
+		}
+		if len(hello.compress) > 1 || (compress != compressNone && !slices.Contains(offer, compress)) {
+			return fmt.Errorf("server selected invalid compression: %v", hello.compress)
+		}
+		hi.compress = compress
+	}
+	return nil
 }
 
 func serverHandshake(r io.Reader, ctx *ServerContext) (hi *handshakeInfo, err error) {
@@ -138,7 +252,11 @@ func serverHandshake(r io.Reader, ctx *ServerContext) (hi *handshakeInfo, err er
 	id := binary.LittleEndian.Uint64(idBytes)
 	// 重放攻击判断
 	if ok := ctx.CheckReplay(id); ok {
-		return nil, fmt.Errorf("replay attack: %d", id)
+		return nil, fmt.Errorf("%w: %d", errReplay, id)
+	}
+	// 公钥的连接数已满时在 ECDH 之前拒绝
+	if ctx.keyFull(buf[keyStartV1:keyEndV1]) {
+		return nil, ErrTooManyConns
 	}
 
 	clientSign := buf[signStartV1:signEndV1]
@@ -151,11 +269,11 @@ func serverHandshake(r io.Reader, ctx *ServerContext) (hi *handshakeInfo, err er
 	}
 	publicKey, err := ecdhNewPublicKey(curve, buf[keyStartV1:keyEndV1])
 	if err != nil {
-		return nil, fmt.Errorf("public key error: %w", err)
+		return nil, fmt.Errorf("public key error: %w: %w", errPeerKey, err)
 	}
 	sharedKey, err := privateKey.ECDH(publicKey)
 	if err != nil {
-		return nil, fmt.Errorf("ecdh error: %w", err)
+		return nil, fmt.Errorf("ecdh error: %w: %w", errPeerKey, err)
 	}
 	// Time window
 	var timeWindowBytes [timeWindowSizeV1]byte
@@ -169,9 +287,21 @@ func serverHandshake(r io.Reader, ctx *ServerContext) (hi *handshakeInfo, err er
 	if _, err = hmacWrite(h, buf[:idEndV1]); err != nil {
 		return nil, fmt.Errorf("hmac write error: %w", err)
 	}
-	sign := h.Sum(nil)
-	if !hmac.Equal(sign, clientSign) {
-		return nil, errors.New("sign error")
+	legacySign := h.Sum(nil)
+	if _, err = hmacWrite(h, []byte(helloSignLabel)); err != nil {
+		return nil, fmt.Errorf("hmac write error: %w", err)
+	}
+	legacy := false
+	switch {
+	case hmac.Equal(h.Sum(nil), clientSign):
+	case hmac.Equal(legacySign, clientSign):
+		// 未升级的客户端, 握手包之后没有 hello
+		if ctx.RejectLegacy {
+			return nil, errors.New("legacy client rejected")
+		}
+		legacy = true
+	default:
+		return nil, errSign
 	}
 
 	// nonce
@@ -179,8 +309,74 @@ func serverHandshake(r io.Reader, ctx *ServerContext) (hi *handshakeInfo, err er
 	if err != nil {
 		return nil, fmt.Errorf("nonce error: %w", err)
 	}
+	if legacy {
+		return &handshakeInfo{
+			newCrypto:  newCrypto,
+			cryptoType: ctx.CryptoType,
+			key:        key,
+			nonce:      nonce,
+			version:    VersionLegacy,
+			peerKey:    bytes.Clone(buf[keyStartV1:keyEndV1]),
+			frameSize:  gcmPacketSize,
+			compress:   compressSnappy,
+		}, nil
+	}
+
+	// hello
+	hello, err := openHello(r, key, helloClient)
+	if err != nil {
+		return nil, fmt.Errorf("hello error: %w", err)
+	}
+	if hello.version != VersionV1 {
+		return nil, fmt.Errorf("unsupported version: %d", hello.version)
+	}
+	protocol, err := selectProtocol(ctx.NextProtos, hello.protocols)
+	if err != nil {
+		return nil, err
+	}
+	frameSize, err := frameSizeOf(ctx.MaxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	if hello.frameSize != 0 && hello.frameSize < gcmPacketSize {
+		return nil, fmt.Errorf("invalid frame size: %d", hello.frameSize)
+	}
+	frameSize = selectFrameSize(frameSize, hello.frameSize)
+	allowed, err := compressIDs(ctx.Compression)
+	if err != nil {
+		return nil, err
+	}
+	offer := hello.compress
+	if len(offer) == 0 {
+		offer = []uint8{compressSnappy}
+	}
+	compress := selectCompression(allowed, offer)
+	if hello.flags&helloFlagWant == 0 && compress != offer[0] {
+		// 客户端不等待回复, 无法告知协商结果
+		return nil, fmt.Errorf("compression not allowed: %d", offer[0])
+	}
 
-	return &handshakeInfo{newCrypto: newCrypto, key: key, nonce: nonce}, nil
+	hi = &handshakeInfo{
+		newCrypto:  newCrypto,
+		cryptoType: ctx.CryptoType,
+		key:        key,
+		nonce:      nonce,
+		version:    hello.version,
+		peerKey:    bytes.Clone(buf[keyStartV1:keyEndV1]),
+		protocol:   protocol,
+		frameSize:  int(frameSize),
+		compress:   compress,
+	}
+	if hello.flags&helloFlagWant != 0 {
+		reply := &helloMsg{version: hi.version, frameSize: frameSize, compress: []uint8{compress}}
+		if protocol != "" {
+			reply.protocols = []string{protocol}
+		}
+		if hi.reply, err = sealHello(key, helloServer, reply); err != nil {
+			return nil, fmt.Errorf("hello error: %w", err)
+		}
+	}
+	return hi, nil
 }
 
 func cryptoFromName(name string) (newAEAD, int, error) {
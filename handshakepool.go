@@ -0,0 +1,163 @@
+package stcp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// 接受连接遇到临时错误时的重试间隔, 每次加倍
+const (
+	acceptMinDelay = 5 * time.Millisecond
+	acceptMaxDelay = time.Second
+)
+
+// handshakePool 监听器的后台握手, 最多 HandshakeWorkers 个连接同时握手
+// 握手完成的连接在被 Accept 取走前继续占用名额, 应用不调用 Accept 时停止接受新连接
+type handshakePool struct {
+	once    sync.Once
+	sem     chan struct{}
+	ready   chan *Conn
+	done    chan struct{}
+	stopped chan struct{}
+	err     error
+
+	mu      sync.Mutex
+	pending map[*Conn]struct{}
+	closed  bool
+}
+
+func (l *listener) startPool() {
+	p := &l.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sem = make(chan struct{}, l.ctx.HandshakeWorkers)
+	p.ready = make(chan *Conn)
+	p.done = make(chan struct{})
+	p.stopped = make(chan struct{})
+	p.pending = make(map[*Conn]struct{})
+	if p.closed {
+		close(p.done)
+	}
+	go l.acceptLoop()
+}
+
+// acceptLoop 接受连接并在后台握手
+// 临时错误 (例如文件描述符耗尽) 时等待后重试, 与 net/http 一致; 监听器关闭或其他错误时退出
+func (l *listener) acceptLoop() {
+	p := &l.pool
+	defer close(p.stopped)
+	var delay time.Duration
+	for {
+		select {
+		case p.sem <- struct{}{}:
+		case <-p.done:
+			return
+		}
+		conn, err := l.accept()
+		if err != nil {
+			<-p.sem
+			if ne, ok := err.(net.Error); ok && ne.Temporary() && !errors.Is(err, net.ErrClosed) {
+				delay = min(max(2*delay, acceptMinDelay), acceptMaxDelay)
+				select {
+				case <-time.After(delay):
+					continue
+				case <-p.done:
+					return
+				}
+			}
+			p.err = err
+			return
+		}
+		delay = 0
+		if !p.add(conn) {
+			<-p.sem
+			conn.Close()
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *listener) handshake(conn *Conn) {
+	p := &l.pool
+	defer func() { <-p.sem }()
+
+	err := conn.Handshake()
+	if !p.remove(conn) {
+		conn.Close()
+		return
+	}
+	if err != nil {
+		if fn := l.ctx.OnHandshakeError; fn != nil {
+			fn(conn, err)
+		}
+		conn.Close()
+		return
+	}
+	select {
+	case p.ready <- conn:
+	case <-p.done:
+		conn.Close()
+	}
+}
+
+// add 记录握手中的连接, 监听器已关闭时返回 false
+func (p *handshakePool) add(conn *Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.pending[conn] = struct{}{}
+	return true
+}
+
+// remove 握手结束, 监听器已关闭时返回 false
+func (p *handshakePool) remove(conn *Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, conn)
+	return !p.closed
+}
+
+// acceptReady 返回握手完成的连接
+func (l *listener) acceptReady() (net.Conn, error) {
+	p := &l.pool
+	p.once.Do(l.startPool)
+	select {
+	case conn := <-p.ready:
+		return conn, nil
+	case <-p.stopped:
+	}
+	// 接受循环已退出, 取走已经握手完成的连接
+	select {
+	case conn := <-p.ready:
+		return conn, nil
+	default:
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return nil, net.ErrClosed
+}
+
+// close 停止接受循环并关闭握手中的连接
+func (p *handshakePool) close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	if p.done != nil {
+		close(p.done)
+	}
+	pending := p.pending
+	p.pending = nil
+	p.mu.Unlock()
+	for conn := range pending {
+		conn.Close()
+	}
+}
@@ -0,0 +1,119 @@
+package stcp
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshakePool(t *testing.T) {
+	newServer := func(t *testing.T) (*ClientConfig, *ServerContext, chan error) {
+		clientConfig, serverCtx := newTestConfig(t)
+		serverCtx.HandshakeWorkers = 2
+		failed := make(chan error, 4)
+		serverCtx.OnHandshakeError = func(c net.Conn, err error) {
+			failed <- err
+		}
+		return clientConfig, serverCtx, failed
+	}
+
+	t.Run("slow client", func(t *testing.T) {
+		clientConfig, serverCtx, _ := newServer(t)
+		ln, err := Listen("tcp", "127.0.0.1:0", serverCtx)
+		require.NoError(t, err)
+		defer ln.Close()
+
+		// 不发送握手数据的连接不影响其他连接
+		silent, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		defer silent.Close()
+
+		go func() {
+			if c, err := Dial("tcp", ln.Addr().String(), clientConfig); err == nil {
+				c.Write([]byte("hello"))
+				time.Sleep(time.Second)
+				c.Close()
+			}
+		}()
+		start := time.Now()
+		c, err := ln.Accept()
+		require.NoError(t, err)
+		defer c.Close()
+		assert.Less(t, time.Since(start), time.Second)
+		assert.True(t, c.(*Conn).handshakeComplete.Load())
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(c, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+
+		// 关闭监听器时关闭握手中的连接
+		ln.Close()
+		silent.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = silent.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+		_, err = ln.Accept()
+		assert.Error(t, err)
+	})
+
+	t.Run("handshake error", func(t *testing.T) {
+		_, serverCtx, failed := newServer(t)
+		ln, err := Listen("tcp", "127.0.0.1:0", serverCtx)
+		require.NoError(t, err)
+		defer ln.Close()
+		go ln.Accept()
+
+		raw, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		defer raw.Close()
+		raw.Write(make([]byte, packetSizeV1))
+		select {
+		case err := <-failed:
+			assert.Error(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("handshake error timeout")
+		}
+		raw.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = raw.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("temporary error", func(t *testing.T) {
+		clientConfig, serverCtx, _ := newServer(t)
+		inner := &flakyListener{Listener: newLocalListener(t)}
+		inner.errs.Store(3)
+		ln := NewListener(inner, serverCtx)
+		defer ln.Close()
+
+		// 临时错误后继续接受连接
+		go func() {
+			if c, err := Dial("tcp", ln.Addr().String(), clientConfig); err == nil {
+				c.Write([]byte("hello"))
+				c.Close()
+			}
+		}()
+		c, err := ln.Accept()
+		require.NoError(t, err)
+		defer c.Close()
+		assert.True(t, c.(*Conn).handshakeComplete.Load())
+		assert.Less(t, inner.errs.Load(), int32(0))
+	})
+}
+
+// flakyListener 前几次 Accept 返回临时错误
+type flakyListener struct {
+	net.Listener
+	errs atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.errs.Add(-1) >= 0 {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	return l.Listener.Accept()
+}
@@ -0,0 +1,193 @@
+package stcp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// hello 消息跟在握手包之后, 用于协商版本和扩展参数
+// 格式: [len u16][version u8][flags u8][ext...][mac 32]
+// ext:  [type u8][len u16][value]
+const (
+	helloLenSize  = 2
+	helloMacSize  = 32
+	helloMinSize  = 2
+	helloMaxSize  = 1024
+	helloExtHead  = 3
+	helloFlagWant = 0x01 // 客户端要求服务端回复 hello
+
+	helloClient = 'C'
+	helloServer = 'S'
+
+	extProtocols = 0x01
+	extFrameSize = 0x02 // 单帧最大明文长度 u32
+	extCompress  = 0x03 // 压缩算法编号列表, 每个 u8
+)
+
+type helloMsg struct {
+	version   uint8
+	flags     uint8
+	protocols []string
+	frameSize uint32
+	compress  []uint8
+}
+
+func (m *helloMsg) marshal() ([]byte, error) {
+	b := []byte{m.version, m.flags}
+	if len(m.protocols) > 0 {
+		var value []byte
+		for _, p := range m.protocols {
+			if len(p) == 0 || len(p) > 255 {
+				return nil, fmt.Errorf("invalid protocol: %q", p)
+			}
+			value = append(value, byte(len(p)))
+			value = append(value, p...)
+		}
+		b = appendExt(b, extProtocols, value)
+	}
+	if m.frameSize > 0 {
+		b = appendExt(b, extFrameSize, binary.LittleEndian.AppendUint32(nil, m.frameSize))
+	}
+	if len(m.compress) > 0 {
+		b = appendExt(b, extCompress, m.compress)
+	}
+	if len(b) > helloMaxSize {
+		return nil, errors.New("hello too long")
+	}
+	return b, nil
+}
+
+func (m *helloMsg) unmarshal(b []byte) error {
+	if len(b) < helloMinSize {
+		return errors.New("hello too short")
+	}
+	m.version = b[0]
+	m.flags = b[1]
+	b = b[helloMinSize:]
+	for len(b) > 0 {
+		if len(b) < helloExtHead {
+			return errors.New("malformed extension")
+		}
+		typ := b[0]
+		n := int(binary.LittleEndian.Uint16(b[1:helloExtHead]))
+		if len(b) < helloExtHead+n {
+			return errors.New("malformed extension")
+		}
+		value := b[helloExtHead : helloExtHead+n]
+		b = b[helloExtHead+n:]
+
+		switch typ {
+		case extProtocols:
+			for len(value) > 0 {
+				l := int(value[0])
+				if l == 0 || len(value) < 1+l {
+					return errors.New("malformed protocols")
+				}
+				m.protocols = append(m.protocols, string(value[1:1+l]))
+				value = value[1+l:]
+			}
+		case extFrameSize:
+			if len(value) != 4 {
+				return errors.New("malformed frame size")
+			}
+			m.frameSize = binary.LittleEndian.Uint32(value)
+		case extCompress:
+			m.compress = append([]uint8(nil), value...)
+		default:
+			// 忽略未知扩展, 便于后续版本兼容
+		}
+	}
+	return nil
+}
+
+func appendExt(b []byte, typ byte, value []byte) []byte {
+	b = append(b, typ)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+func helloMac(key []byte, dir byte, payload []byte) ([]byte, error) {
+	h := hmac.New(sha256.New, key)
+	if _, err := hmacWrite(h, []byte{dir}); err != nil {
+		return nil, err
+	}
+	if _, err := hmacWrite(h, payload); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// sealHello 编码 hello 消息并附加 HMAC 签名
+func sealHello(key []byte, dir byte, m *helloMsg) ([]byte, error) {
+	payload, err := m.marshal()
+	if err != nil {
+		return nil, err
+	}
+	mac, err := helloMac(key, dir, payload)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, helloLenSize+len(payload)+helloMacSize)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(payload)))
+	b = append(b, payload...)
+	return append(b, mac...), nil
+}
+
+// openHello 读取并校验 hello 消息
+func openHello(r io.Reader, key []byte, dir byte) (*helloMsg, error) {
+	var head [helloLenSize]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		// 握手包之后连接结束, 握手不完整
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	n := int(binary.LittleEndian.Uint16(head[:]))
+	if n < helloMinSize || n > helloMaxSize {
+		return nil, errors.New("invalid hello length")
+	}
+	buf := make([]byte, n+helloMacSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	mac, err := helloMac(key, dir, buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, buf[n:]) {
+		return nil, fmt.Errorf("hello %w", errSign)
+	}
+	m := new(helloMsg)
+	if err = m.unmarshal(buf[:n]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// selectProtocol 按服务端优先级选择双方都支持的应用层协议
+func selectProtocol(serverProtos, clientProtos []string) (string, error) {
+	if len(serverProtos) == 0 || len(clientProtos) == 0 {
+		return "", nil
+	}
+	for _, s := range serverProtos {
+		for _, c := range clientProtos {
+			if s == c {
+				return s, nil
+			}
+		}
+	}
+	return "", errors.New("no application protocol")
+}
+
+// selectFrameSize 取双方单帧大小的较小值, 未声明时使用默认值
+func selectFrameSize(server, client uint32) uint32 {
+	if client == 0 {
+		return gcmPacketSize
+	}
+	return min(server, client)
+}
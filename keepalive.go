@@ -0,0 +1,177 @@
+package stcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+const pingPayloadSize = 8
+
+// ErrKeepAliveTimeout 表示在保活超时时间内没有收到对端任何帧
+var ErrKeepAliveTimeout = errors.New("stcp: keepalive timeout")
+
+type KeepAliveConfig struct {
+	// 保活间隔, 为 0 时不主动发送保活帧
+	KeepAlive time.Duration `yaml:"keep_alive"`
+	// 保活超时时间, 正在读取时超过该时间没有收到任何帧则断开连接, 为 0 时取 3 倍保活间隔
+	// 控制帧在 Read 时处理, 没有调用 Read 时不检查超时, 只发送保活帧
+	KeepAliveTimeout time.Duration `yaml:"keep_alive_timeout"`
+}
+
+func (k *KeepAliveConfig) keepAliveTimeout() time.Duration {
+	if k.KeepAliveTimeout > 0 {
+		return k.KeepAliveTimeout
+	}
+	return 3 * k.KeepAlive
+}
+
+// rttStats 按 RFC 6298 计算平滑往返时间
+type rttStats struct {
+	mu     sync.Mutex
+	srtt   time.Duration
+	rttvar time.Duration
+}
+
+func (s *rttStats) update(rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.srtt == 0 {
+		s.srtt = rtt
+		s.rttvar = rtt / 2
+		return
+	}
+	delta := s.srtt - rtt
+	if delta < 0 {
+		delta = -delta
+	}
+	s.rttvar = (3*s.rttvar + delta) / 4
+	s.srtt = (7*s.srtt + rtt) / 8
+}
+
+func (s *rttStats) get() (srtt, rttvar time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.srtt, s.rttvar
+}
+
+// RTT 返回平滑往返时间和往返时间偏差, 尚未测量时均为 0
+// 往返时间通过保活 ping/pong 测量, 需要开启 KeepAlive
+func (c *Conn) RTT() (srtt, rttvar time.Duration) {
+	return c.rtt.get()
+}
+
+func (c *Conn) keepAliveConfig() *KeepAliveConfig {
+	if c.clientConfig != nil {
+		return &c.clientConfig.KeepAliveConfig
+	}
+	if c.serverCtx != nil {
+		return &c.serverCtx.KeepAliveConfig
+	}
+	return nil
+}
+
+func (c *Conn) keepAlive(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		if c.readIdle(timeout) {
+			c.abort(ErrKeepAliveTimeout)
+			return
+		}
+
+		// 正在写入时对端能收到数据, 无需额外保活
+		if !c.out.TryLock() {
+			continue
+		}
+		err := c.sendPing(timeout)
+		c.out.Unlock()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// 对端长时间不读取, 写缓冲区已满
+			c.abort(ErrKeepAliveTimeout)
+			return
+		}
+	}
+}
+
+// readIdle 返回正在读取时是否超过 timeout 没有收到任何帧
+// 应用没有调用 Read 时对端的帧留在接收缓冲区中, 无法判断对端是否存活
+func (c *Conn) readIdle(timeout time.Duration) bool {
+	since := c.readSince.Load()
+	if since == 0 {
+		return false
+	}
+	last := max(since, c.gcmReader.LastRead().UnixNano())
+	return time.Since(unixNano(last)) > timeout
+}
+
+// sendPing 发送 ping 帧, 上一个 ping 未收到回复时改为发送保活帧, 调用方需持有写锁
+// 写入最多阻塞 timeout, 避免对端不读取时保活协程被卡住
+func (c *Conn) sendPing(timeout time.Duration) error {
+	if c.closed.Load() || c.writeClosed {
+		return nil
+	}
+	defer c.stat.tempWriteDeadline(time.Now().Add(timeout))()
+	c.flushPong()
+	if c.pingSent.Load() {
+		_, err := c.gcmWriter.writeFrame(FrameKeepAlive, nil)
+		return err
+	}
+	var payload [pingPayloadSize]byte
+	binary.LittleEndian.PutUint64(payload[:], uint64(time.Since(c.epoch)))
+	_, err := c.gcmWriter.writeFrame(FramePing, payload[:])
+	if err == nil {
+		c.pingSent.Store(true)
+	}
+	return err
+}
+
+// flushPong 发送待回复的 pong 帧, 调用方需持有写锁
+func (c *Conn) flushPong() {
+	payload := c.pendingPong.Swap(nil)
+	if payload == nil || c.closed.Load() || c.writeClosed {
+		return
+	}
+	c.gcmWriter.writeFrame(FramePong, payload[:])
+}
+
+// handlePing 回复对端的 ping
+func (c *Conn) handlePing(payload []byte) error {
+	if len(payload) != pingPayloadSize {
+		return errors.New("stcp: invalid ping frame")
+	}
+	var p [pingPayloadSize]byte
+	copy(p[:], payload)
+	c.pendingPong.Store(&p)
+	// 写锁被占用时由写协程在写入后回复, 避免读协程被阻塞
+	if c.out.TryLock() {
+		c.flushPong()
+		c.out.Unlock()
+	}
+	return nil
+}
+
+// handlePong 根据 pong 中回显的时间戳更新往返时间
+func (c *Conn) handlePong(payload []byte) error {
+	if len(payload) != pingPayloadSize {
+		return errors.New("stcp: invalid pong frame")
+	}
+	sent := time.Duration(binary.LittleEndian.Uint64(payload))
+	if rtt := time.Since(c.epoch) - sent; rtt > 0 {
+		c.rtt.update(rtt)
+	}
+	c.pingSent.Store(false)
+	return nil
+}
+
+func handleKeepAlive([]byte) error {
+	return nil
+}
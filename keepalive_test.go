@@ -0,0 +1,137 @@
+package stcp
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeepAlive(t *testing.T) {
+	t.Run("rtt", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		clientConfig.KeepAlive = 10 * time.Millisecond
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+
+		// 控制帧在 Read 中处理, 两端都需要读取
+		go io.Copy(io.Discard, server)
+		go io.Copy(io.Discard, client)
+
+		assert.Eventually(t, func() bool {
+			srtt, _ := client.RTT()
+			return srtt > 0
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// 服务端未开启保活, 不会测量往返时间
+		srtt, rttvar := server.RTT()
+		assert.Zero(t, srtt)
+		assert.Zero(t, rttvar)
+
+		// 控制帧不影响数据读写
+		_, err = client.Write([]byte("hello"))
+		require.NoError(t, err)
+	})
+
+	t.Run("data with ping", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		clientConfig.KeepAlive = time.Millisecond
+		clientConfig.KeepAliveTimeout = 5 * time.Second
+		serverCtx.KeepAlive = time.Millisecond
+		serverCtx.KeepAliveTimeout = 5 * time.Second
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				if _, err := client.Write([]byte("hello")); err != nil {
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+			client.CloseWrite()
+		}()
+		go io.Copy(io.Discard, client)
+		data, err := io.ReadAll(server)
+		require.NoError(t, err)
+		assert.Len(t, data, 500)
+		<-done
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		serverCtx.KeepAlive = 10 * time.Millisecond
+		serverCtx.KeepAliveTimeout = 50 * time.Millisecond
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+
+		// 客户端不读取也不写入, 相当于对端失联
+		start := time.Now()
+		_, err = server.Read(make([]byte, 16))
+		assert.ErrorIs(t, err, ErrKeepAliveTimeout)
+		assert.Less(t, time.Since(start), 5*time.Second)
+
+		_, err = server.Write([]byte("hello"))
+		assert.Error(t, err)
+	})
+
+	t.Run("write only", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		clientConfig.KeepAlive = 10 * time.Millisecond
+		clientConfig.KeepAliveTimeout = 50 * time.Millisecond
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+
+		// 客户端只写不读, 没有在读取时不检查超时
+		go io.Copy(io.Discard, server)
+		for range 20 {
+			_, err = client.Write([]byte("hello"))
+			require.NoError(t, err)
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Nil(t, client.abortErr.Load())
+	})
+
+	t.Run("stalled write", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		serverCtx.KeepAlive = 10 * time.Millisecond
+		serverCtx.KeepAliveTimeout = 50 * time.Millisecond
+		// 管道的写入在对端读取前一直阻塞
+		client, server, err := newTestPipe(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+
+		// 两端都不读取, 保活帧的写入超时后中断连接
+		assert.Eventually(t, func() bool {
+			return server.abortErr.Load() != nil
+		}, 5*time.Second, 10*time.Millisecond)
+		_, err = server.Write([]byte("hello"))
+		assert.ErrorIs(t, err, ErrKeepAliveTimeout)
+	})
+}
+
+func TestRTTStats(t *testing.T) {
+	var s rttStats
+	s.update(100 * time.Millisecond)
+	srtt, rttvar := s.get()
+	assert.Equal(t, 100*time.Millisecond, srtt)
+	assert.Equal(t, 50*time.Millisecond, rttvar)
+
+	s.update(20 * time.Millisecond)
+	srtt, rttvar = s.get()
+	assert.Equal(t, 90*time.Millisecond, srtt)
+	assert.Equal(t, 57500*time.Microsecond, rttvar)
+}
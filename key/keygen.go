@@ -3,6 +3,8 @@ package key
 import (
 	"crypto/ecdh"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"os"
 	"strings"
 
@@ -27,6 +29,12 @@ func PublicKey(key types.Binary) (publicKey types.Binary, err error) {
 	return privateKey.PublicKey().Bytes(), nil
 }
 
+// Fingerprint 返回公钥指纹, 格式为 SHA256:<base64>
+func Fingerprint(publicKey types.Binary) string {
+	sum := sha256.Sum256(publicKey)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
 func Generate(keyPath string) (privateKey types.Binary, err error) {
 	curve := ecdh.X25519()
 	if _, err = os.Stat(keyPath); err != nil {
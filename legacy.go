@@ -0,0 +1,61 @@
+package stcp
+
+import (
+	"errors"
+	"io"
+)
+
+// 原始协议: 未升级的对端使用的格式
+// 握手包之后没有 hello, 签名不带 helloSignLabel
+// 帧格式: [len u16][ciphertext][tag], 没有帧类型和附加数据, 长度为 0 的帧表示 EOF
+// 两个方向都使用握手密钥和 nonce, 数据为 snappy 流格式
+const (
+	legacyHeaderSize = 2
+
+	// helloSignLabel 升级后的客户端在握手签名中加入该标记, 表示握手包之后跟着 hello
+	helloSignLabel = "stcp hello"
+)
+
+// errLegacy 原始协议不支持控制帧、自定义帧和不压缩写入
+var errLegacy = errors.New("stcp: not supported by legacy peer")
+
+// legacyFormat 原始协议的帧格式
+var legacyFormat = frameFormat{frameSize: gcmPacketSize, headerSize: legacyHeaderSize, legacy: true}
+
+// legacyStream 原始协议的 snappy 流
+type legacyStream struct {
+	r *SnappyReader
+	w *SnappyWriter
+}
+
+func newLegacyStream(r io.Reader, w io.Writer) *legacyStream {
+	return &legacyStream{r: NewSnappyReader(r), w: NewSnappyWriter(w)}
+}
+
+func (s *legacyStream) Read(b []byte) (int, error) {
+	return s.r.Read(b)
+}
+
+// Write 写入后立即刷新, 与原始协议一致
+func (s *legacyStream) Write(b []byte) (int, error) {
+	return s.w.Write(b)
+}
+
+// setLegacy 使用原始协议的帧格式, 需要在读取前调用
+func (r *SecureReader) setLegacy() {
+	r.frameFormat = legacyFormat
+}
+
+// setLegacy 使用原始协议的帧格式, 需要在写入前调用
+func (w *SecureWriter) setLegacy() {
+	w.frameFormat = legacyFormat
+}
+
+// writeLegacyFrame 原始协议只支持长度为 0 的 EOF 帧
+func (w *SecureWriter) writeLegacyFrame(typ FrameType) (int, error) {
+	if typ != FrameEOF {
+		return 0, errLegacy
+	}
+	var eof [legacyHeaderSize]byte
+	return 0, w.flush(eof[:])
+}
@@ -0,0 +1,281 @@
+package stcp
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/taodev/pkg/types"
+)
+
+// baselineTolerance 配置的默认时间窗口
+const baselineTolerance = 120
+
+// baselinePeer 按未升级版本的格式收发数据:
+// 72 字节握手包, 之后是 [len u16][ciphertext][tag] 记录, 两个方向使用相同的密钥和 nonce, 数据为 snappy 流
+type baselinePeer struct {
+	conn   net.Conn
+	aead   cipher.AEAD
+	nonce  []byte
+	rid    uint64
+	wid    uint64
+	snappy *snappy.Writer
+	rbuf   []byte // 已解密未读取的数据
+}
+
+// baselineKeys 按原始协议从握手包派生密钥和 nonce
+func baselineKeys(t *testing.T, sharedKey, packet []byte) (key, nonce []byte) {
+	t.Helper()
+	var tw [timeWindowSizeV1]byte
+	binary.LittleEndian.PutUint64(tw[:], uint64(types.TimeWindow(time.Now().Unix(), baselineTolerance)))
+	hexTimeWindow := hex.EncodeToString(tw[:])
+	key, err := hkdfKey(sha256.New, sharedKey, packet[:idEndV1], hexTimeWindow, keySizeV1)
+	require.NoError(t, err)
+	nonce, err = hkdfKey(sha256.New, key, packet[signStartV1:signEndV1], hexTimeWindow, gcmNonceSize)
+	require.NoError(t, err)
+	return key, nonce
+}
+
+func newBaselinePeer(t *testing.T, conn net.Conn, key, nonce []byte) *baselinePeer {
+	t.Helper()
+	aead, err := newAES256GCM(key)
+	require.NoError(t, err)
+	p := &baselinePeer{conn: conn, aead: aead, nonce: nonce}
+	p.rid = binary.LittleEndian.Uint64(nonce[:idSizeV1])
+	p.wid = p.rid
+	p.snappy = snappy.NewBufferedWriter(recordWriter{p})
+	return p
+}
+
+// dialBaseline 作为未升级的客户端完成握手
+func dialBaseline(t *testing.T, conn net.Conn, serverPub []byte) *baselinePeer {
+	t.Helper()
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	pub, err := ecdh.X25519().NewPublicKey(serverPub)
+	require.NoError(t, err)
+	sharedKey, err := priv.ECDH(pub)
+	require.NoError(t, err)
+
+	var packet [packetSizeV1]byte
+	copy(packet[keyStartV1:keyEndV1], priv.PublicKey().Bytes())
+	_, err = rand.Read(packet[idStartV1:idEndV1])
+	require.NoError(t, err)
+	var tw [timeWindowSizeV1]byte
+	binary.LittleEndian.PutUint64(tw[:], uint64(types.TimeWindow(time.Now().Unix(), baselineTolerance)))
+	key, err := hkdfKey(sha256.New, sharedKey, packet[:idEndV1], hex.EncodeToString(tw[:]), keySizeV1)
+	require.NoError(t, err)
+	h := hmac.New(sha256.New, key)
+	h.Write(packet[:idEndV1])
+	copy(packet[signStartV1:signEndV1], h.Sum(nil))
+	_, nonce := baselineKeys(t, sharedKey, packet[:])
+
+	_, err = conn.Write(packet[:])
+	require.NoError(t, err)
+	return newBaselinePeer(t, conn, key, nonce)
+}
+
+// acceptBaseline 作为未升级的服务端完成握手
+func acceptBaseline(t *testing.T, conn net.Conn, serverKey []byte) *baselinePeer {
+	t.Helper()
+	var packet [packetSizeV1]byte
+	_, err := io.ReadFull(conn, packet[:])
+	require.NoError(t, err)
+	priv, err := ecdh.X25519().NewPrivateKey(serverKey)
+	require.NoError(t, err)
+	pub, err := ecdh.X25519().NewPublicKey(packet[keyStartV1:keyEndV1])
+	require.NoError(t, err)
+	sharedKey, err := priv.ECDH(pub)
+	require.NoError(t, err)
+	key, nonce := baselineKeys(t, sharedKey, packet[:])
+	h := hmac.New(sha256.New, key)
+	h.Write(packet[:idEndV1])
+	require.True(t, hmac.Equal(h.Sum(nil), packet[signStartV1:signEndV1]), "sign error")
+	return newBaselinePeer(t, conn, key, nonce)
+}
+
+func (p *baselinePeer) nextNonce(id *uint64) []byte {
+	*id++
+	nonce := append([]byte(nil), p.nonce...)
+	binary.LittleEndian.PutUint64(nonce[:idSizeV1], *id)
+	return nonce
+}
+
+// Write 与原始协议一致, 每次写入后刷新 snappy 流
+func (p *baselinePeer) Write(b []byte) (int, error) {
+	if _, err := p.snappy.Write(b); err != nil {
+		return 0, err
+	}
+	return len(b), p.snappy.Flush()
+}
+
+// recordWriter 将 snappy 流切分为加密记录
+type recordWriter struct{ p *baselinePeer }
+
+func (w recordWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b[:min(len(b), gcmPacketSize)]
+		rec := w.p.aead.Seal(make([]byte, 2, 2+len(chunk)+gcmTagSize), w.p.nextNonce(&w.p.wid), chunk, nil)
+		binary.LittleEndian.PutUint16(rec, uint16(len(rec)-2))
+		if _, err = w.p.conn.Write(rec); err != nil {
+			return
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return
+}
+
+// Reader 返回解密后的 snappy 流, 长度为 0 的记录视为 EOF
+func (p *baselinePeer) Reader() io.Reader {
+	return snappy.NewReader(recordReader{p})
+}
+
+type recordReader struct{ p *baselinePeer }
+
+func (r recordReader) Read(b []byte) (int, error) {
+	if len(r.p.rbuf) > 0 {
+		n := copy(b, r.p.rbuf)
+		r.p.rbuf = r.p.rbuf[n:]
+		return n, nil
+	}
+	var hdr [2]byte
+	if _, err := io.ReadFull(r.p.conn, hdr[:]); err != nil {
+		return 0, err
+	}
+	rawLen := binary.LittleEndian.Uint16(hdr[:])
+	if rawLen == 0 {
+		return 0, io.EOF
+	}
+	if int(rawLen) > gcmPacketSize+gcmTagSize {
+		return 0, errors.New("message too long")
+	}
+	rec := make([]byte, rawLen)
+	if _, err := io.ReadFull(r.p.conn, rec); err != nil {
+		return 0, err
+	}
+	plain, err := r.p.aead.Open(rec[:0], r.p.nextNonce(&r.p.rid), rec, nil)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(b, plain)
+	r.p.rbuf = plain[n:]
+	return n, nil
+}
+
+// newLocalPair 返回一对本地 TCP 连接
+func newLocalPair(t *testing.T) (c, s net.Conn) {
+	t.Helper()
+	ln := newLocalListener(t)
+	defer ln.Close()
+	c, err := net.Dial(ln.Addr().Network(), ln.Addr().String())
+	require.NoError(t, err)
+	s, err = ln.Accept()
+	require.NoError(t, err)
+	return c, s
+}
+
+func TestLegacy(t *testing.T) {
+	data := make([]byte, 3*gcmPacketSize+100)
+	rand.Read(data)
+
+	t.Run("baseline client", func(t *testing.T) {
+		_, serverCtx := newTestConfig(t)
+		c, s := newLocalPair(t)
+		defer c.Close()
+		server := Server(s, serverCtx)
+		defer server.Close()
+
+		peer := dialBaseline(t, c, testServerPub)
+		_, err := peer.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, server.Handshake())
+		assert.Equal(t, uint8(VersionLegacy), server.version)
+
+		buf := make([]byte, len(data))
+		_, err = io.ReadFull(server, buf)
+		require.NoError(t, err)
+		assert.Equal(t, data, buf)
+
+		_, err = server.Write([]byte("pong"))
+		require.NoError(t, err)
+		buf = make([]byte, 4)
+		_, err = io.ReadFull(peer.Reader(), buf)
+		require.NoError(t, err)
+		assert.Equal(t, "pong", string(buf))
+
+		// 原始协议不支持控制帧和自定义帧
+		assert.ErrorIs(t, server.WriteFrame(FrameUserMin, nil), errLegacy)
+		_, err = server.WriteSensitive([]byte("secret"))
+		assert.ErrorIs(t, err, errLegacy)
+
+		// 未升级的对端直接关闭连接
+		c.Close()
+		_, err = server.Read(buf)
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("baseline server", func(t *testing.T) {
+		clientConfig, _ := newTestConfig(t)
+		clientConfig.Legacy = true
+		c, s := newLocalPair(t)
+		defer s.Close()
+		client := Client(c, clientConfig)
+		defer client.Close()
+
+		_, err := client.Write(data)
+		require.NoError(t, err)
+		peer := acceptBaseline(t, s, testServerKey)
+		buf := make([]byte, len(data))
+		r := peer.Reader()
+		_, err = io.ReadFull(r, buf)
+		require.NoError(t, err)
+		assert.Equal(t, data, buf)
+
+		_, err = peer.Write([]byte("pong"))
+		require.NoError(t, err)
+		buf = make([]byte, 4)
+		_, err = io.ReadFull(client, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "pong", string(buf))
+
+		// 关闭时发送长度为 0 的记录, 未升级的对端视为 EOF
+		require.NoError(t, client.CloseWrite())
+		_, err = r.Read(buf)
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("reject legacy", func(t *testing.T) {
+		_, serverCtx := newTestConfig(t)
+		serverCtx.RejectLegacy = true
+		c, s := newLocalPair(t)
+		defer c.Close()
+		server := Server(s, serverCtx)
+		defer server.Close()
+
+		dialBaseline(t, c, testServerPub)
+		assert.ErrorContains(t, server.Handshake(), "legacy client rejected")
+	})
+
+	t.Run("upgraded", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+		assert.Equal(t, uint8(VersionV1), client.version)
+		assert.Equal(t, uint8(VersionV1), server.version)
+	})
+}
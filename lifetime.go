@@ -0,0 +1,113 @@
+package stcp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrIdleTimeout 表示连接在 IdleTimeout 内没有收发应用数据
+	ErrIdleTimeout = errors.New("stcp: idle timeout")
+	// ErrMaxLifetime 表示连接超过了 MaxLifetime
+	ErrMaxLifetime = errors.New("stcp: max lifetime exceeded")
+)
+
+// closeReasons Close 帧中的原因码, 下标为原因码, 0 保留
+var closeReasons = []error{nil, ErrIdleTimeout, ErrMaxLifetime, ErrServerClosed}
+
+type LifetimeConfig struct {
+	// 空闲超时, 超过该时间没有收发数据帧和自定义帧时关闭连接, 保活帧不计入, 为 0 时不限
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// 最长存活时间, 从握手完成开始计算, 为 0 时不限
+	MaxLifetime time.Duration `yaml:"max_lifetime"`
+}
+
+func (c *Conn) lifetimeConfig() *LifetimeConfig {
+	if c.clientConfig != nil {
+		return &c.clientConfig.LifetimeConfig
+	}
+	if c.serverCtx != nil {
+		return &c.serverCtx.LifetimeConfig
+	}
+	return nil
+}
+
+// lastActive 返回最近一次收发应用数据的时间, 没有收发过时为握手完成时间
+func (c *Conn) lastActive() time.Time {
+	last := c.epoch
+	if t := c.gcmReader.LastData(); t.After(last) {
+		last = t
+	}
+	if t := c.gcmWriter.LastData(); t.After(last) {
+		last = t
+	}
+	return last
+}
+
+// watchLifetime 空闲超时或超过最长存活时间时关闭连接
+func (c *Conn) watchLifetime(idle, maxLifetime time.Duration) {
+	expire := c.epoch.Add(maxLifetime)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		if maxLifetime > 0 && !now.Before(expire) {
+			c.closeWith(ErrMaxLifetime)
+			return
+		}
+		next := time.Duration(1<<63 - 1)
+		if maxLifetime > 0 {
+			next = expire.Sub(now)
+		}
+		if idle > 0 {
+			wait := c.lastActive().Add(idle).Sub(now)
+			if wait <= 0 {
+				c.closeWith(ErrIdleTimeout)
+				return
+			}
+			next = min(next, wait)
+		}
+		timer.Reset(next)
+	}
+}
+
+// closeWith 因 err 关闭连接, 先向对端发送携带原因的 Close 帧, 之后的读写返回 err
+func (c *Conn) closeWith(err error) {
+	if !c.abortErr.CompareAndSwap(nil, &err) {
+		c.Close()
+		return
+	}
+	if c.handshakeComplete.Load() && c.out.TryLock() {
+		if !c.closed.Load() && !c.writeClosed {
+			var code byte
+			for i, reason := range closeReasons {
+				if reason == err {
+					code = byte(i)
+				}
+			}
+			c.stat.SetWriteDeadline(time.Now().Add(closeNotifyTimeout))
+			if c.flush() == nil {
+				c.gcmWriter.writeFrame(FrameClose, []byte{code})
+			}
+		}
+		c.out.Unlock()
+	}
+	c.Close()
+}
+
+// handleClose 对端因 Close 帧中的原因关闭连接, 之后的读写返回该原因
+func (c *Conn) handleClose(payload []byte) error {
+	err := fmt.Errorf("stcp: closed by peer: %v", payload)
+	if len(payload) == 1 && payload[0] > 0 && int(payload[0]) < len(closeReasons) {
+		err = closeReasons[payload[0]]
+	}
+	c.abort(err)
+	return err
+}
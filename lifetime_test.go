@@ -0,0 +1,93 @@
+package stcp
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLifetime(t *testing.T) {
+	// readErr 在后台读取, 返回读取结束时的错误
+	readErr := func(c *Conn) chan error {
+		ch := make(chan error, 1)
+		go func() {
+			buf := make([]byte, 1024)
+			for {
+				if _, err := c.Read(buf); err != nil {
+					ch <- err
+					return
+				}
+			}
+		}()
+		return ch
+	}
+	wait := func(t *testing.T, ch chan error) error {
+		select {
+		case err := <-ch:
+			return err
+		case <-time.After(2 * time.Second):
+			t.Fatal("read timeout")
+			return nil
+		}
+	}
+
+	t.Run("idle timeout", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		serverCtx.IdleTimeout = 200 * time.Millisecond
+		// 保活帧不计入
+		clientConfig.KeepAlive = 20 * time.Millisecond
+		serverCtx.KeepAlive = 20 * time.Millisecond
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+
+		clientErr, serverErr := readErr(client), readErr(server)
+		// 应用数据刷新空闲时间
+		for range 5 {
+			time.Sleep(100 * time.Millisecond)
+			_, err = client.Write([]byte("ping"))
+			require.NoError(t, err)
+		}
+		start := time.Now()
+		assert.ErrorIs(t, wait(t, clientErr), ErrIdleTimeout)
+		assert.ErrorIs(t, wait(t, serverErr), ErrIdleTimeout)
+		assert.Greater(t, time.Since(start), 100*time.Millisecond)
+		assert.True(t, server.closed.Load())
+	})
+
+	t.Run("max lifetime", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		clientConfig.MaxLifetime = 100 * time.Millisecond
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+
+		serverErr := readErr(server)
+		assert.ErrorIs(t, wait(t, serverErr), ErrMaxLifetime)
+		assert.True(t, client.closed.Load())
+		_, err = client.Write([]byte("ping"))
+		assert.Error(t, err)
+	})
+
+	t.Run("buffered", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		clientConfig.WriteBuffered = true
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+
+		// 关闭前先发送缓冲区中的数据
+		_, err = client.Write([]byte("tail"))
+		require.NoError(t, err)
+		client.closeWith(ErrMaxLifetime)
+		data, err := io.ReadAll(server)
+		assert.ErrorIs(t, err, ErrMaxLifetime)
+		assert.Equal(t, "tail", string(data))
+	})
+}
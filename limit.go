@@ -1,6 +1,11 @@
 package stcp
 
-import "golang.org/x/time/rate"
+import (
+	"cmp"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
 
 type LimitConfig struct {
 	Limiter      *rate.Limiter `yaml:"-"`
@@ -10,6 +15,17 @@ type LimitConfig struct {
 	LimitN      int `yaml:"limit"`
 	ReadLimitN  int `yaml:"read_limit"`
 	WriteLimitN int `yaml:"write_limit"`
+
+	// 所有连接共享的总带宽, 仅服务端有效
+	GlobalLimit Limits `yaml:"global_limit"`
+	// 同一客户端公钥的所有连接共享的带宽, 仅服务端有效
+	IdentityLimit Limits `yaml:"identity_limit"`
+}
+
+// Limits 读写带宽, 单位字节/秒, 为 0 时不限速
+type Limits struct {
+	Read  int `yaml:"read"`
+	Write int `yaml:"write"`
 }
 
 func (l *LimitConfig) GetReadLimiter() *rate.Limiter {
@@ -43,3 +59,173 @@ func (l *LimitConfig) GetWriteLimiter() *rate.Limiter {
 	}
 	return nil
 }
+
+// connLimits 返回单个连接的带宽, ReadLimitN/WriteLimitN 优先于 LimitN
+func (l *LimitConfig) connLimits() Limits {
+	limits := Limits{Read: l.LimitN, Write: l.LimitN}
+	if l.ReadLimitN > 0 {
+		limits.Read = l.ReadLimitN
+	}
+	if l.WriteLimitN > 0 {
+		limits.Write = l.WriteLimitN
+	}
+	return limits
+}
+
+// limiters 去掉为 nil 的限速器
+func limiters(ls ...*rate.Limiter) []*rate.Limiter {
+	var out []*rate.Limiter
+	for _, l := range ls {
+		if l != nil {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// minBurst 返回限速器中最小的突发值, 都不限速时返回 0
+func minBurst(ls []*rate.Limiter) int {
+	n := 0
+	for _, l := range ls {
+		if l.Limit() == rate.Inf {
+			continue
+		}
+		if b := l.Burst(); n == 0 || b < n {
+			n = b
+		}
+	}
+	return n
+}
+
+// newLimiter 创建限速器, n 为 0 时不限速, 之后可以通过 setLimiter 修改
+func newLimiter(n int) *rate.Limiter {
+	l := rate.NewLimiter(rate.Inf, 0)
+	setLimiter(l, n)
+	return l
+}
+
+func setLimiter(l *rate.Limiter, n int) {
+	if n <= 0 {
+		l.SetLimit(rate.Inf)
+		l.SetBurst(0)
+		return
+	}
+	l.SetLimit(rate.Limit(n))
+	l.SetBurst(n)
+}
+
+// limiterPair 一个级别的读写限速器
+type limiterPair struct {
+	r *rate.Limiter
+	w *rate.Limiter
+}
+
+func newLimiterPair(limits Limits) *limiterPair {
+	return &limiterPair{r: newLimiter(limits.Read), w: newLimiter(limits.Write)}
+}
+
+func (p *limiterPair) set(limits Limits) {
+	setLimiter(p.r, limits.Read)
+	setLimiter(p.w, limits.Write)
+}
+
+// identityLimiter 同一公钥的连接共享的限速器, 最后一个连接关闭时删除
+type identityLimiter struct {
+	limiterPair
+	refs int
+}
+
+// limitGroup 服务端的分级限速器: 总带宽、单个公钥和单个连接
+// 每次读写需要同时满足所有级别, SetLimits 修改后对已建立的连接立即生效
+// 多个连接共享的总带宽和 Limiter/ReadLimiter/WriteLimiter 按 KeyPolicy.Weight 公平调度
+type limitGroup struct {
+	mu       sync.Mutex
+	global   *limiterPair
+	identity map[string]*identityLimiter
+	conns    map[*limiterPair]struct{}
+	fair     map[*rate.Limiter]*fairLimiter
+}
+
+// fairFlow 返回共享限速器 l 上权重为 weight 的连接, 调用方需持有 g.mu
+func (g *limitGroup) fairFlow(l *rate.Limiter, weight int) *fairFlow {
+	q := g.fair[l]
+	if q == nil {
+		q = newFairLimiter(l)
+		g.fair[l] = q
+	}
+	return q.flow(weight)
+}
+
+// acquireLimiters 返回连接使用的读写限速器, 连接关闭时需要调用 release
+// 配置了 Limiter/ReadLimiter/WriteLimiter 时替代单个连接的限速器, 由所有连接共享, 不受 SetLimits 影响
+func (ctx *ServerContext) acquireLimiters(peerKey []byte) (r, w limitSet, release func()) {
+	g := &ctx.limits
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.global == nil {
+		g.global = newLimiterPair(ctx.GlobalLimit)
+		g.identity = make(map[string]*identityLimiter)
+		g.conns = make(map[*limiterPair]struct{})
+		g.fair = make(map[*rate.Limiter]*fairLimiter)
+	}
+	weight := ctx.keyPolicy(peerKey).Weight
+	r.fair = []*fairFlow{g.fairFlow(g.global.r, weight)}
+	w.fair = []*fairFlow{g.fairFlow(g.global.w, weight)}
+
+	id := string(peerKey)
+	il := g.identity[id]
+	if il == nil {
+		il = &identityLimiter{limiterPair: *newLimiterPair(ctx.IdentityLimit)}
+		g.identity[id] = il
+	}
+	il.refs++
+	r.ls = append(r.ls, il.r)
+	w.ls = append(w.ls, il.w)
+
+	conn := newLimiterPair(ctx.connLimits())
+	g.conns[conn] = struct{}{}
+	if l := cmp.Or(ctx.ReadLimiter, ctx.Limiter); l != nil {
+		r.fair = append(r.fair, g.fairFlow(l, weight))
+	} else {
+		r.ls = append(r.ls, conn.r)
+	}
+	if l := cmp.Or(ctx.WriteLimiter, ctx.Limiter); l != nil {
+		w.fair = append(w.fair, g.fairFlow(l, weight))
+	} else {
+		w.ls = append(w.ls, conn.w)
+	}
+
+	release = func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		delete(g.conns, conn)
+		if il.refs--; il.refs == 0 {
+			delete(g.identity, id)
+		}
+	}
+	return
+}
+
+// SetLimits 修改总带宽、单个公钥和单个连接的带宽, 对已建立的连接立即生效
+// 单个连接的带宽覆盖 LimitN/ReadLimitN/WriteLimitN
+func (ctx *ServerContext) SetLimits(global, identity, conn Limits) {
+	g := &ctx.limits
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ctx.GlobalLimit = global
+	ctx.IdentityLimit = identity
+	ctx.LimitN, ctx.ReadLimitN, ctx.WriteLimitN = 0, conn.Read, conn.Write
+
+	if g.global == nil {
+		return
+	}
+	g.global.set(global)
+	for _, il := range g.identity {
+		il.set(identity)
+	}
+	for p := range g.conns {
+		p.set(conn)
+	}
+}
@@ -0,0 +1,98 @@
+package stcp
+
+import (
+	"crypto/rand"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestConnLimits(t *testing.T) {
+	clientConfig, serverCtx := newTestConfig(t)
+
+	newConns := func(t *testing.T) (client, server *Conn) {
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			client.Close()
+			server.Close()
+		})
+		return client, server
+	}
+
+	t.Run("hierarchy", func(t *testing.T) {
+		_, s1 := newConns(t)
+		_, s2 := newConns(t)
+		// 总带宽和同一公钥的限速器共享, 单个连接的限速器独立
+		require.Len(t, s1.stat.rL.fair, 1)
+		require.Len(t, s1.stat.rL.ls, 3)
+		assert.Same(t, s1.stat.rL.fair[0].q, s2.stat.rL.fair[0].q)
+		assert.Same(t, s1.stat.wL.ls[0], s2.stat.wL.ls[0])
+		assert.NotSame(t, s1.stat.rL.ls[1], s2.stat.rL.ls[1])
+
+		s1.Close()
+		s2.Close()
+		serverCtx.limits.mu.Lock()
+		assert.Empty(t, serverCtx.limits.identity)
+		assert.Empty(t, serverCtx.limits.conns)
+		serverCtx.limits.mu.Unlock()
+	})
+
+	t.Run("set limits", func(t *testing.T) {
+		client, server := newConns(t)
+		go io.Copy(io.Discard, client)
+		// 都不限速时读写不经过限速器
+		assert.True(t, server.stat.rL.empty())
+		assert.True(t, server.stat.wL.empty())
+		_, err := server.Write([]byte("hello"))
+		require.NoError(t, err)
+		assert.Zero(t, server.gcmWriter.maxBatch)
+
+		serverCtx.SetLimits(Limits{Write: 1 << 20}, Limits{Read: 1 << 19}, Limits{Read: 1 << 18, Write: 16 * 1024})
+		defer serverCtx.SetLimits(Limits{}, Limits{}, Limits{})
+		assert.False(t, server.stat.rL.empty())
+		assert.False(t, server.stat.wL.empty())
+		// 合并写入的上限随限速器更新
+		_, err = server.Write([]byte("hello"))
+		require.NoError(t, err)
+		assert.Equal(t, 16*1024, server.gcmWriter.maxBatch)
+
+		assert.Equal(t, rate.Inf, server.stat.rL.fair[0].q.l.Limit())
+		assert.Equal(t, rate.Limit(1<<20), server.stat.wL.fair[0].q.l.Limit())
+		assert.Equal(t, rate.Limit(1<<19), server.stat.rL.ls[0].Limit())
+		assert.Equal(t, rate.Limit(1<<18), server.stat.rL.ls[1].Limit())
+		assert.Equal(t, 1<<18, server.stat.rL.burst())
+
+		// 之后建立的连接使用新的限制
+		_, server2 := newConns(t)
+		assert.Equal(t, rate.Limit(1<<18), server2.stat.rL.ls[1].Limit())
+	})
+
+	t.Run("global", func(t *testing.T) {
+		serverCtx.SetLimits(Limits{Write: 32 * 1024}, Limits{}, Limits{})
+		defer serverCtx.SetLimits(Limits{}, Limits{}, Limits{})
+
+		// 两个连接共享总带宽, 共写入 32KB, 从不限速修改后令牌为空, 需要约 1 秒
+		data := make([]byte, 16*1024)
+		rand.Read(data)
+		start := time.Now()
+		var wg sync.WaitGroup
+		for range 2 {
+			client, server := newConns(t)
+			go io.Copy(io.Discard, client)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := server.Write(data)
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+		assert.Greater(t, time.Since(start), 500*time.Millisecond)
+	})
+}
@@ -0,0 +1,260 @@
+package stcp
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/bytedance/gopkg/lang/mcache"
+)
+
+// 并行加解密
+// 每帧的 nonce 按顺序预先分配, 多个协程同时加密或解密一批帧, 帧在连接上的顺序不变
+// 只影响本端的处理方式, 无需对端支持
+
+func (c *Conn) parallel() int {
+	if c.clientConfig != nil {
+		return c.clientConfig.Parallel
+	}
+	if c.serverCtx != nil {
+		return c.serverCtx.Parallel
+	}
+	return 0
+}
+
+// parallelDo 将 [0, n) 分成 workers 段并发执行 fn, worker 为段的编号
+func parallelDo(workers, n int, fn func(worker, i int)) {
+	per := (n + workers - 1) / workers
+	var wg sync.WaitGroup
+	for worker, start := 0, 0; start < n; worker, start = worker+1, start+per {
+		end := min(start+per, n)
+		run := func(worker, start, end int) {
+			for i := start; i < end; i++ {
+				fn(worker, i)
+			}
+		}
+		// 最后一段在当前协程执行
+		if end == n {
+			run(worker, start, end)
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run(worker, start, end)
+		}()
+	}
+	wg.Wait()
+}
+
+// batchFrames 返回并行模式下一批处理的帧数
+func (f frameFormat) batchFrames(workers int) int {
+	return workers * max(gcmBatchSize/f.cacheSize(), 1)
+}
+
+// setParallel 开启并行加密, 需要在 setCodec 之后调用
+func (w *SecureWriter) setParallel(workers int) {
+	if workers <= 1 {
+		return
+	}
+	frames := w.batchFrames(workers)
+	w.release()
+	w.buf = mcache.Malloc(frames * w.cacheSize())
+	w.workers = workers
+	w.states = make([]sealState, workers)
+	if w.codec != nil {
+		for i := range w.states {
+			w.states[i].cbuf = mcache.Malloc(w.codec.maxEncodedLen(w.frameSize))
+		}
+	}
+	w.nonces = make([][maxNonceSize]byte, frames)
+	w.srcs = make([][]byte, frames)
+	w.lens = make([]int, frames)
+}
+
+// parallelFrames 返回一批最多处理的帧数, 受 maxBatch 限制
+func (w *SecureWriter) parallelFrames() int {
+	frames := len(w.nonces)
+	if w.maxBatch > 0 {
+		frames = max(min(frames, w.maxBatch/w.cacheSize()), 1)
+	}
+	return frames
+}
+
+// sealBatch 并行加密 srcs 中的前 k 帧, 第 i 帧写入第 i 个帧槽, 之后按顺序紧凑排列, 返回总长度
+func (w *SecureWriter) sealBatch(k int, compress bool) int {
+	slot := w.cacheSize()
+	for i := 0; i < k; i++ {
+		copy(w.nonces[i][:], w.nextNonce())
+	}
+	parallelDo(w.workers, k, func(worker, i int) {
+		dst := w.buf[i*slot : (i+1)*slot]
+		w.lens[i] = w.sealDataWith(&w.states[worker], w.nonces[i][:w.nonceSize], dst, w.srcs[i], compress)
+	})
+
+	// 压缩后的帧长度不同, 需要移动到前一帧之后
+	pos := 0
+	for i := 0; i < k; i++ {
+		if start := i * slot; start != pos {
+			copy(w.buf[pos:], w.buf[start:start+w.lens[i]])
+		}
+		pos += w.lens[i]
+		w.srcs[i] = nil
+	}
+	return pos
+}
+
+func (w *SecureWriter) writeParallel(b []byte, compress bool) (n int, err error) {
+	frames := w.parallelFrames()
+	for len(b) > 0 {
+		k, sealed := 0, 0
+		for k < frames && len(b) > 0 {
+			m := min(len(b), w.frameSize)
+			w.srcs[k] = b[:m]
+			b = b[m:]
+			sealed += m
+			k++
+		}
+		if err = w.flush(w.buf[:w.sealBatch(k, compress)]); err != nil {
+			return
+		}
+		n += sealed
+	}
+	return
+}
+
+func (w *SecureWriter) readFromParallel(r io.Reader) (n int64, err error) {
+	frames := w.parallelFrames()
+	slot, hdr := w.cacheSize(), w.headerSize
+	for {
+		var rerr error
+		k := 0
+		for k < frames {
+			// 明文读入帧槽的密文位置, 原地加密
+			p := w.buf[k*slot+hdr : k*slot+hdr+w.frameSize]
+			var m int
+			m, rerr = r.Read(p)
+			if m > 0 {
+				w.srcs[k] = p[:m]
+				n += int64(m)
+				k++
+			}
+			if rerr != nil || m < w.frameSize {
+				break
+			}
+		}
+		if k > 0 {
+			if err = w.flush(w.buf[:w.sealBatch(k, true)]); err != nil {
+				return
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// openedFrame 并行解密后等待处理的帧
+type openedFrame struct {
+	typ    FrameType
+	p      []byte
+	err    error
+	sticky bool // 解密失败, 之后的帧已使用 nonce 并被丢弃, 之后的读取都返回该错误
+}
+
+// setParallel 开启并行解密, 底层连接通过 bufio 预读, 已完整到达的帧一起解密
+func (r *SecureReader) setParallel(workers int) {
+	if workers <= 1 {
+		return
+	}
+	frames := r.batchFrames(workers)
+	r.workers = workers
+	r.br = bufio.NewReaderSize(r.inner, frames*r.cacheSize())
+	r.inner = r.br
+	r.batch = mcache.Malloc(frames * r.cacheSize())
+	r.frames = make([]openedFrame, 0, frames)
+	r.ads = make([][gcmWideHeaderSize + 2]byte, workers)
+	r.nonces = make([][maxNonceSize]byte, frames)
+	r.rawLens = make([]int, frames)
+}
+
+func (r *SecureReader) readParallel(b []byte, direct bool) ([]byte, error) {
+	if r.next == len(r.frames) {
+		r.fill()
+	}
+	f := r.frames[r.next]
+	r.next++
+	if f.err != nil {
+		r.frames, r.next = r.frames[:0], 0
+		if f.sticky {
+			return nil, r.fail(f.err)
+		}
+		return nil, f.err
+	}
+	p, err := r.process(f.typ, f.p, b, direct)
+	if direct && f.typ == FrameData {
+		// 数据已解密在帧槽中
+		p = b[:copy(b, p)]
+	}
+	return p, err
+}
+
+// fill 读取一帧以及已经到达的后续帧, 并行解密
+func (r *SecureReader) fill() {
+	r.frames, r.next = r.frames[:0], 0
+	slot, hdr := r.cacheSize(), r.headerSize
+
+	var rerr error
+	k := 0
+	for k < len(r.rawLens) {
+		// 第一帧之后只读取已完整缓冲的帧, 避免阻塞
+		if k > 0 && !r.buffered() {
+			break
+		}
+		if r.rawLens[k], rerr = r.readRaw(r.batch[k*slot:]); rerr != nil {
+			break
+		}
+		k++
+	}
+
+	for i := 0; i < k; i++ {
+		copy(r.nonces[i][:], r.nextNonce())
+	}
+	r.frames = r.frames[:k]
+	parallelDo(r.workers, k, func(worker, i int) {
+		buf := r.batch[i*slot:]
+		ciphertext := buf[hdr : hdr+r.rawLens[i]]
+		p, err := r.gcm.Open(ciphertext[:0], r.nonces[i][:r.nonceSize], ciphertext,
+			r.frameFormat.ad(r.ads[worker][:0], buf, r.dir, r.version))
+		r.frames[i] = openedFrame{typ: FrameType(buf[hdr-1]), p: p, err: err, sticky: err != nil}
+	})
+
+	// 解密失败之后的帧不再处理
+	for i := range r.frames {
+		if r.frames[i].err != nil {
+			r.frames = r.frames[:i+1]
+			return
+		}
+	}
+	if k > 0 {
+		r.lastRead.Store(time.Now().UnixNano())
+	}
+	if rerr != nil {
+		r.frames = append(r.frames, openedFrame{err: rerr})
+	}
+}
+
+// buffered 判断下一帧是否已经完整缓冲
+func (r *SecureReader) buffered() bool {
+	hdr := r.headerSize
+	n := r.br.Buffered()
+	if n < hdr {
+		return false
+	}
+	h, _ := r.br.Peek(hdr)
+	return n >= hdr+r.getLen(h)
+}
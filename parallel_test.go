@@ -0,0 +1,167 @@
+package stcp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParallel(t *testing.T) {
+	key := make([]byte, 32)
+	io.ReadFull(rand.Reader, key)
+	nonce := make([]byte, gcmNonceSize)
+	io.ReadFull(rand.Reader, nonce)
+
+	data := make([]byte, 300*1024+77)
+	io.ReadFull(rand.Reader, data)
+	// 一半可压缩, 压缩帧和原始帧交错
+	copy(data[100*1024:], bytes.Repeat([]byte("parallel "), 10*1024))
+
+	newWriter := func(buf io.Writer, workers int, c codec) *SecureWriter {
+		aead, err := newAES256GCM(key)
+		require.NoError(t, err)
+		w := NewSecureWriter(buf, aead, nonce)
+		w.setCodec(c)
+		w.setParallel(workers)
+		return w
+	}
+	newReader := func(p []byte, workers int, c codec) *SecureReader {
+		aead, err := newAES256GCM(key)
+		require.NoError(t, err)
+		r := NewSecureReader(bytes.NewReader(p), aead, nonce)
+		r.codec = c
+		r.setParallel(workers)
+		return r
+	}
+
+	for _, c := range []codec{nil, snappyCodec{}} {
+		// 串行加密的结果作为对照
+		var serial bytes.Buffer
+		w := newWriter(&serial, 1, c)
+		_, err := w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.CloseWrite())
+		w.Close()
+
+		t.Run(fmt.Sprintf("write %T", c), func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newWriter(&buf, 4, c)
+			defer w.Close()
+			n, err := w.Write(data)
+			require.NoError(t, err)
+			assert.Equal(t, len(data), n)
+			require.NoError(t, w.CloseWrite())
+			assert.Equal(t, serial.Bytes(), buf.Bytes())
+		})
+
+		t.Run(fmt.Sprintf("read from %T", c), func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newWriter(&buf, 4, c)
+			defer w.Close()
+			n, err := w.ReadFrom(bytes.NewReader(data))
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(data)), n)
+			require.NoError(t, w.CloseWrite())
+
+			r := newReader(buf.Bytes(), 1, c)
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+		})
+
+		t.Run(fmt.Sprintf("read %T", c), func(t *testing.T) {
+			r := newReader(serial.Bytes(), 4, c)
+			defer r.Close()
+			// 大小缓冲区交替读取
+			var got []byte
+			small, big := make([]byte, 1000), make([]byte, 2*gcmPacketSize)
+			for i := 0; ; i++ {
+				p := small
+				if i%2 == 0 {
+					p = big
+				}
+				n, err := r.Read(p)
+				got = append(got, p[:n]...)
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+			}
+			assert.Equal(t, data, got)
+		})
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		var buf bytes.Buffer
+		w := newWriter(&buf, 1, nil)
+		defer w.Close()
+		_, err := w.Write(data[:10*gcmPacketSize])
+		require.NoError(t, err)
+		// 篡改第 4 帧
+		p := buf.Bytes()
+		p[3*(gcmHeaderSize+gcmPacketSize+gcmTagSize)+gcmHeaderSize] ^= 0xff
+
+		r := newReader(p, 4, nil)
+		defer r.Close()
+		got, err := io.ReadAll(r)
+		assert.ErrorContains(t, err, "cipher")
+		assert.Equal(t, data[:3*gcmPacketSize], got)
+
+		// 之后的帧已被丢弃, 再次读取返回同样的错误而不是后续数据
+		n, err2 := r.Read(make([]byte, gcmPacketSize))
+		assert.Equal(t, 0, n)
+		assert.Equal(t, err, err2)
+	})
+}
+
+func TestConnParallel(t *testing.T) {
+	clientConfig, serverCtx := newTestConfig(t)
+	clientConfig.Parallel = 4
+	serverCtx.Parallel = 3
+	client, server, err := newTestConns(t, clientConfig, serverCtx)
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+	go func() {
+		client.Write(data)
+		client.CloseWrite()
+	}()
+	got, err := io.ReadAll(server)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func BenchmarkParallel(b *testing.B) {
+	key := make([]byte, 32)
+	io.ReadFull(rand.Reader, key)
+	nonce := make([]byte, gcmNonceSize)
+	io.ReadFull(rand.Reader, nonce)
+	data := make([]byte, 1024*1024)
+	io.ReadFull(rand.Reader, data)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			aead, err := newAES256GCM(key)
+			require.NoError(b, err)
+			w := NewSecureWriterSize(io.Discard, aead, nonce, 16*1024)
+			w.setParallel(workers)
+			defer w.Close()
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := w.Write(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package stcp
+
+import "github.com/taodev/stcp/key"
+
+// KeyPolicy 单个客户端公钥的策略, 在 ServerContext.KeyPolicies 中按公钥指纹配置
+type KeyPolicy struct {
+	// 共享限速器饱和时按权重分配带宽, 为 0 时取 1
+	Weight int `yaml:"weight"`
+	// 每月 (UTC 自然月) 的流量配额, 按读写字节数合计, 为 0 时不限
+	MonthlyQuota int64 `yaml:"monthly_quota"`
+	// 配额用尽后的读写限速 (字节/秒), 为 0 时断开该公钥的连接并拒绝新连接
+	QuotaThrottle int `yaml:"quota_throttle"`
+	// 最大并发数, 为 0 时使用 ServerContext.MaxConnsPerKey
+	MaxConns int `yaml:"max_conns"`
+	// 允许使用该公钥的来源网段 (CIDR 或单个 IP), 为空时不限, 在认证通过后检查
+	From []string `yaml:"from"`
+}
+
+// keyPolicy 返回客户端公钥的策略, 没有配置时返回零值
+func (ctx *ServerContext) keyPolicy(peerKey []byte) KeyPolicy {
+	return ctx.KeyPolicies[key.Fingerprint(peerKey)]
+}
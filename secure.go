@@ -1,23 +1,102 @@
 package stcp
 
 import (
+	"bufio"
 	"crypto/cipher"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"sync/atomic"
+	"time"
 
 	"github.com/bytedance/gopkg/lang/mcache"
 )
 
+// 帧格式: [len][type u8][ciphertext][tag]
+// len 默认为 u16, 单帧大小超过 u16 能表示的范围时为 u32
+// 附加数据为帧头加上方向和协议版本: [len][type u8][dir u8][version u8]
 const (
-	gcmHeaderSize  = 2
+	gcmHeaderSize  = 3
 	gcmNonceSize   = 12
 	gcmTagSize     = 16
 	gcmPacketSize  = 4 * 1024
 	gcmPacketCache = gcmHeaderSize + gcmPacketSize + gcmTagSize
+
+	gcmWideHeaderSize = 5
+	// 单次写入合并的帧总长度, 至少包含一帧
+	gcmBatchSize = 64 * 1024
+	// 单帧最大明文长度的上限
+	maxFrameSizeLimit = 1024 * 1024
+	// 小于该长度的数据帧不压缩
+	compressMinSize = 64
+)
+
+// frameFormat 描述单帧大小和帧头格式, 两端需要一致
+type frameFormat struct {
+	frameSize  int  // 单帧最大明文长度
+	headerSize int  // 帧头长度
+	legacy     bool // 原始协议, 见 legacy.go
+}
+
+func newFrameFormat(frameSize int) frameFormat {
+	f := frameFormat{frameSize: frameSize, headerSize: gcmHeaderSize}
+	if frameSize+gcmTagSize > math.MaxUint16 {
+		f.headerSize = gcmWideHeaderSize
+	}
+	return f
+}
+
+func (f frameFormat) cacheSize() int {
+	return f.headerSize + f.frameSize + gcmTagSize
+}
+
+// batchSize 返回写缓冲区大小, 能容纳整数个完整帧
+func (f frameFormat) batchSize() int {
+	n := max(gcmBatchSize/f.cacheSize(), 1)
+	return n * f.cacheSize()
+}
+
+func (f frameFormat) putLen(b []byte, n int) {
+	if f.headerSize == gcmWideHeaderSize {
+		binary.LittleEndian.PutUint32(b, uint32(n))
+	} else {
+		binary.LittleEndian.PutUint16(b, uint16(n))
+	}
+}
+
+func (f frameFormat) getLen(b []byte) int {
+	if f.headerSize == gcmWideHeaderSize {
+		return int(binary.LittleEndian.Uint32(b))
+	}
+	return int(binary.LittleEndian.Uint16(b))
+}
+
+// ad 组装附加数据, 原始协议没有附加数据
+func (f frameFormat) ad(ad, header []byte, dir byte, version uint8) []byte {
+	if f.legacy {
+		return nil
+	}
+	ad = append(ad[:0], header[:f.headerSize]...)
+	return append(ad, dir, version)
+}
+
+var (
+	// ErrTruncated 表示底层连接在收到 EOF 帧之前被关闭, 数据可能被截断
+	ErrTruncated = fmt.Errorf("stcp: stream truncated: %w", io.ErrUnexpectedEOF)
+
+	errShutdown = errors.New("stcp: write side closed")
 )
 
+// truncated 将底层连接的 EOF 转换为 ErrTruncated
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
+
 type SecureReader struct {
 	inner     io.Reader
 	gcm       cipher.AEAD
@@ -25,10 +104,40 @@ type SecureReader struct {
 	nonceId   uint64
 	nonceSize int
 
-	buf   []byte
-	rbuf  []byte
+	// 帧头单独读取, 等待数据时不占用帧缓冲区
+	hbuf [gcmWideHeaderSize]byte
+	// 帧缓冲区, 只在读取过程中或有剩余数据时持有, 见 acquire 和 release
+	buf  []byte
+	rbuf []byte
+	// 解压缓冲区, 收到压缩帧时分配
+	dbuf []byte
+	// 上一帧剩余的数据, 以及在其中的起始位置和长度
+	pend  []byte
+	off   int
 	readn int
 
+	frameFormat
+	dir      byte
+	version  uint8
+	ad       [gcmWideHeaderSize + 2]byte
+	codec    codec
+	handlers map[FrameType]FrameHandler
+
+	// 并行解密, 见 setParallel
+	workers int
+	br      *bufio.Reader
+	batch   []byte
+	frames  []openedFrame
+	next    int
+	ads     [][gcmWideHeaderSize + 2]byte
+	nonces  [][maxNonceSize]byte
+	rawLens []int
+
+	// 最近一次收到帧的时间 (UnixNano)
+	lastRead atomic.Int64
+	// 最近一次收到数据帧或自定义帧的时间 (UnixNano)
+	lastData atomic.Int64
+
 	err error
 }
 
@@ -41,7 +150,19 @@ func (r *SecureReader) Close() error {
 		mcache.Free(r.buf)
 		r.buf = nil
 	}
+	if r.dbuf != nil {
+		mcache.Free(r.dbuf)
+		r.dbuf = nil
+	}
+	if r.batch != nil {
+		mcache.Free(r.batch)
+		r.batch = nil
+	}
+	r.br = nil
+	r.frames = nil
 	r.rbuf = nil
+	r.pend = nil
+	r.off, r.readn = 0, 0
 
 	if r.err == nil {
 		r.err = io.ErrClosedPipe
@@ -65,74 +186,284 @@ func (r *SecureReader) Read(b []byte) (n int, err error) {
 		return 0, r.err
 	}
 
-	if r.readn <= 0 {
-		if err = r.read(); err != nil {
-			return
-		}
-	}
+	defer r.release()
 
-	n = copy(b, r.rbuf[:r.readn])
-	r.readn -= n
+	// 上一帧剩余的数据
 	if r.readn > 0 {
-		copy(r.rbuf, r.rbuf[n:n+r.readn])
+		n = copy(b, r.pend[r.off:r.off+r.readn])
+		r.off += n
+		r.readn -= n
+		return
 	}
 
+	// 调用方缓冲区能容纳一整帧时直接解密或解压到 b, 省去一次拷贝
+	direct := len(b) >= r.frameSize
+	var p []byte
+	for len(p) == 0 {
+		if p, err = r.read(b, direct); err != nil {
+			return 0, err
+		}
+	}
+	if direct {
+		return len(p), nil
+	}
+
+	r.pend = p
+	n = copy(b, p)
+	r.off = n
+	r.readn = len(p) - n
 	return
 }
 
-func (r *SecureReader) read() (err error) {
-	// 读取消息头
-	if _, err = io.ReadFull(r.inner, r.buf[:gcmHeaderSize]); err != nil {
-		return
+// acquire 从内存池获取帧缓冲区
+func (r *SecureReader) acquire() {
+	if r.buf == nil {
+		r.buf = mcache.Malloc(r.cacheSize())
+		r.rbuf = r.buf[r.headerSize:]
 	}
+}
 
-	// 解析消息长度
-	rawLen := binary.LittleEndian.Uint16(r.buf[:gcmHeaderSize])
-	if rawLen == 0 {
-		// 若消息长度为 0，视为读取到文件末尾
-		return io.EOF
+// release 没有剩余数据时将帧缓冲区归还内存池, 大量空闲连接不占用缓冲区
+// 并行模式需要预读, 缓冲区一直持有
+func (r *SecureReader) release() {
+	if r.readn > 0 || r.workers > 1 {
+		return
+	}
+	r.pend, r.off = nil, 0
+	if r.buf != nil {
+		mcache.Free(r.buf)
+		r.buf, r.rbuf = nil, nil
+	}
+	if r.dbuf != nil {
+		mcache.Free(r.dbuf)
+		r.dbuf = nil
 	}
+}
 
-	if rawLen > gcmPacketCache-gcmHeaderSize {
-		// 若消息长度超出最大限制，返回错误
-		return errors.New("stcp: message too long")
+// WriteTo 将解密后的数据直接写入 w, 直到收到对端的 EOF 帧或出错
+func (r *SecureReader) WriteTo(w io.Writer) (n int64, err error) {
+	if r.inner == nil {
+		return 0, io.ErrClosedPipe
+	}
+	if r.err == io.EOF {
+		return 0, nil
 	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	defer r.release()
+
+	p := r.pend[r.off : r.off+r.readn]
+	r.off, r.readn = 0, 0
+	for {
+		if len(p) > 0 {
+			m, err := w.Write(p)
+			n += int64(m)
+			if err == nil && m < len(p) {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				// 保留未写出的数据, 之后的 Read 可以继续读取
+				r.pend, r.off, r.readn = p, m, len(p)-m
+				return n, err
+			}
+		}
+		if p, err = r.read(nil, false); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+	}
+}
 
-	if rawLen <= gcmTagSize {
-		// 若消息长度小于 GCM 标签长度，返回错误
-		return errors.New("stcp: message too short")
+// LastRead 返回最近一次收到帧的时间, 包括控制帧
+func (r *SecureReader) LastRead() time.Time {
+	return time.Unix(0, r.lastRead.Load())
+}
+
+// LastData 返回最近一次收到数据帧或自定义帧的时间, 不包括控制帧, 尚未收到时为零值
+func (r *SecureReader) LastData() time.Time {
+	return unixNano(r.lastData.Load())
+}
+
+// read 读取并解密一帧, 返回数据帧的内容, 非数据帧返回 nil
+// direct 为 true 时数据写入 b, 否则写入内部缓冲区
+func (r *SecureReader) read(b []byte, direct bool) (p []byte, err error) {
+	if r.workers > 1 {
+		return r.readParallel(b, direct)
 	}
 
-	// 读取原始数据
-	if _, err = io.ReadFull(r.inner, r.buf[gcmHeaderSize:gcmHeaderSize+rawLen]); err != nil {
-		return
+	hdr := r.headerSize
+	rawLen, err := r.readHeader(r.hbuf[:hdr])
+	if err != nil {
+		return nil, err
+	}
+	// 帧头到达后才获取缓冲区
+	r.acquire()
+	copy(r.buf, r.hbuf[:hdr])
+	if err = r.readBody(r.buf, rawLen); err != nil {
+		return nil, err
 	}
 
 	// 解密数据
-	// 使用 AES GCM 解密加密消息
+	// 使用 AES GCM 解密加密消息, 帧头、方向和版本作为附加数据校验
+	typ := FrameData
+	if !r.legacy {
+		typ = FrameType(r.buf[hdr-1])
+	}
+	dst := r.rbuf
+	if direct && typ == FrameData {
+		dst = b
+	}
 	plaintext, err := r.gcm.Open(
-		r.rbuf[:0],
+		dst[:0],
 		r.nextNonce(),
-		r.buf[gcmHeaderSize:gcmHeaderSize+rawLen],
-		nil)
+		r.buf[hdr:hdr+rawLen],
+		r.frameFormat.ad(r.ad[:0], r.buf, r.dir, r.version))
 	if err != nil {
+		return nil, r.fail(err)
+	}
+
+	r.lastRead.Store(time.Now().UnixNano())
+	return r.process(typ, plaintext, b, direct)
+}
+
+// readRaw 读取一帧的帧头和密文到 buf, 返回密文长度
+func (r *SecureReader) readRaw(buf []byte) (rawLen int, err error) {
+	if rawLen, err = r.readHeader(buf[:r.headerSize]); err != nil {
 		return
 	}
+	return rawLen, r.readBody(buf, rawLen)
+}
 
-	r.readn = len(plaintext)
-	return
+// readHeader 读取帧头, 返回密文长度
+func (r *SecureReader) readHeader(h []byte) (rawLen int, err error) {
+	// 读取消息头
+	if n, err := io.ReadFull(r.inner, h); err != nil {
+		// 原始协议没有 EOF 帧, 对端直接关闭连接
+		if r.legacy && err == io.EOF {
+			r.err = io.EOF
+			return 0, io.EOF
+		}
+		// 未读到任何数据时 (例如读取超时) 可以重试, 否则已经处于帧中间
+		if n == 0 {
+			return 0, truncated(err)
+		}
+		return 0, r.fail(truncated(err))
+	}
+
+	// 解析消息长度
+	rawLen = r.getLen(h)
+	if r.legacy && rawLen == 0 {
+		r.err = io.EOF
+		return 0, io.EOF
+	}
+	if rawLen > r.frameSize+gcmTagSize {
+		// 若消息长度超出最大限制，返回错误
+		return 0, r.fail(errors.New("stcp: message too long"))
+	}
+
+	if rawLen < gcmTagSize {
+		// 若消息长度小于 GCM 标签长度，返回错误
+		return 0, r.fail(errors.New("stcp: message too short"))
+	}
+	return rawLen, nil
+}
+
+// readBody 读取密文到帧头之后
+func (r *SecureReader) readBody(buf []byte, rawLen int) error {
+	hdr := r.headerSize
+	if _, err := io.ReadFull(r.inner, buf[hdr:hdr+rawLen]); err != nil {
+		return r.fail(truncated(err))
+	}
+	return nil
+}
+
+// fail 读取到一半的帧无法恢复, 之后的读取都返回 err
+func (r *SecureReader) fail(err error) error {
+	r.err = err
+	return err
+}
+
+// process 按帧类型处理解密后的帧
+func (r *SecureReader) process(typ FrameType, plaintext, b []byte, direct bool) ([]byte, error) {
+	if typ == FrameData || typ == FrameCompressed || typ >= FrameUserMin {
+		r.lastData.Store(r.lastRead.Load())
+	}
+	switch typ {
+	case FrameData:
+		return plaintext, nil
+	case FrameCompressed:
+		return r.decompress(b, direct, plaintext)
+	case FrameEOF:
+		// 对端正常关闭写方向
+		r.err = io.EOF
+		return nil, io.EOF
+	default:
+		// 非数据帧交给注册的处理函数, 不返回给调用方
+		h, ok := r.handlers[typ]
+		if !ok {
+			return nil, fmt.Errorf("stcp: unknown frame type: %s", typ)
+		}
+		return nil, h(plaintext)
+	}
+}
+
+// decompress 解压压缩帧, 解压后的长度不能超过单帧大小
+func (r *SecureReader) decompress(b []byte, direct bool, src []byte) ([]byte, error) {
+	if r.codec == nil {
+		return nil, errUncompressed
+	}
+	dst := b
+	if !direct {
+		if r.dbuf == nil {
+			r.dbuf = mcache.Malloc(r.frameSize)
+		}
+		dst = r.dbuf
+	}
+	dst = dst[:r.frameSize]
+	n, err := r.codec.decode(dst, src)
+	if err != nil {
+		return nil, err
+	}
+	return dst[:n], nil
+}
+
+// Handle 注册非数据帧的处理函数, h 为 nil 时取消注册
+func (r *SecureReader) Handle(typ FrameType, h FrameHandler) {
+	if h == nil {
+		delete(r.handlers, typ)
+		return
+	}
+	if r.handlers == nil {
+		r.handlers = make(map[FrameType]FrameHandler)
+	}
+	r.handlers[typ] = h
+}
+
+// bind 设置附加数据中的方向和协议版本, 两端需要一致
+func (r *SecureReader) bind(dir byte, version uint8) {
+	r.dir = dir
+	r.version = version
 }
 
 func NewSecureReader(inner io.Reader, aead cipher.AEAD, nonce []byte) *SecureReader {
+	return NewSecureReaderSize(inner, aead, nonce, gcmPacketSize)
+}
+
+// NewSecureReaderSize 创建单帧最大明文长度为 frameSize 的 SecureReader
+func NewSecureReaderSize(inner io.Reader, aead cipher.AEAD, nonce []byte, frameSize int) *SecureReader {
+	f := newFrameFormat(frameSize)
 	r := &SecureReader{
-		inner: inner,
-		gcm:   aead,
-		buf:   mcache.Malloc(gcmPacketCache),
+		inner:       inner,
+		gcm:         aead,
+		frameFormat: f,
 	}
 	r.nonceSize = aead.NonceSize()
 	copy(r.nonceBase[idSizeV1:], nonce[idSizeV1:])
 	r.nonceId = binary.LittleEndian.Uint64(nonce[:idSizeV1])
-	r.rbuf = r.buf[gcmHeaderSize:]
+	r.lastRead.Store(time.Now().UnixNano())
 	return r
 }
 
@@ -143,11 +474,36 @@ type SecureWriter struct {
 	nonceId   uint64
 	nonceSize int
 
+	// 帧缓冲区, 只在写入过程中持有, 见 acquire 和 release
 	buf []byte
+	sealState
+	codec codec
+	// 单次写入合并的最大字节数, 为 0 时不限制, 至少写入一帧
+	maxBatch int
+	frameFormat
+	dir     byte
+	version uint8
+
+	// 最近一次发送数据帧或自定义帧的时间 (UnixNano)
+	lastData atomic.Int64
+
+	// 并行加密, 见 setParallel
+	workers int
+	states  []sealState
+	nonces  [][maxNonceSize]byte
+	srcs    [][]byte
+	lens    []int
 
 	err error
 }
 
+// sealState 加密一帧时使用的临时缓冲区, 并行加密时每个协程独立使用
+type sealState struct {
+	// 压缩缓冲区, 设置压缩算法时分配
+	cbuf []byte
+	ad   [gcmWideHeaderSize + 2]byte
+}
+
 func (w *SecureWriter) Close() error {
 	w.inner = nil
 	w.gcm = nil
@@ -157,6 +513,16 @@ func (w *SecureWriter) Close() error {
 		mcache.Free(w.buf)
 		w.buf = nil
 	}
+	if w.cbuf != nil {
+		mcache.Free(w.cbuf)
+		w.cbuf = nil
+	}
+	for i := range w.states {
+		if w.states[i].cbuf != nil {
+			mcache.Free(w.states[i].cbuf)
+		}
+	}
+	w.states = nil
 	if w.err == nil {
 		w.err = io.ErrClosedPipe
 	}
@@ -173,57 +539,262 @@ func (w *SecureWriter) nextNonce() []byte {
 }
 
 func (w *SecureWriter) Write(b []byte) (n int, err error) {
+	return w.write(b, true)
+}
+
+// write 分帧加密发送 b, compress 为 false 时不压缩
+func (w *SecureWriter) write(b []byte, compress bool) (n int, err error) {
 	if w.inner == nil {
 		return 0, io.ErrClosedPipe
 	}
 	if w.err != nil {
 		return 0, w.err
 	}
-	writen := 0
+	w.acquire()
+	defer w.release()
+	if w.workers > 1 {
+		return w.writeParallel(b, compress)
+	}
+	limit := len(w.buf)
+	if w.maxBatch > 0 {
+		limit = min(limit, w.maxBatch)
+	}
 	for len(b) > 0 {
-		if writen, err = w.write(b); err != nil {
+		// 将多个帧加密到同一缓冲区, 合并为一次写入, 减少系统调用
+		pos, sealed := 0, 0
+		for len(b) > 0 && (pos == 0 || pos+w.cacheSize() <= limit) {
+			m := min(len(b), w.frameSize)
+			pos += w.sealData(w.buf[pos:], b[:m], compress)
+			sealed += m
+			b = b[m:]
+		}
+		if err = w.flush(w.buf[:pos]); err != nil {
 			return
 		}
-		n += writen
-		b = b[writen:]
+		n += sealed
 	}
 
 	return
 }
 
-func (w *SecureWriter) write(b []byte) (n int, err error) {
-	if len(b) > gcmPacketSize {
-		b = b[:gcmPacketSize]
+// ReadFrom 从 r 读取数据直接填充到帧缓冲区中加密发送, 直到 r 返回 io.EOF
+// 一次读取填满一帧时继续读取下一帧并合并发送, 否则立即发送
+func (w *SecureWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	if w.inner == nil {
+		return 0, io.ErrClosedPipe
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.acquire()
+	defer w.release()
+	if w.workers > 1 {
+		return w.readFromParallel(r)
+	}
+	limit := len(w.buf)
+	if w.maxBatch > 0 {
+		limit = min(limit, w.maxBatch)
+	}
+	hdr := w.headerSize
+	for {
+		var rerr error
+		pos := 0
+		for pos == 0 || pos+w.cacheSize() <= limit {
+			// 明文直接读入帧的密文位置, 原地加密
+			var m int
+			m, rerr = r.Read(w.buf[pos+hdr : pos+hdr+w.frameSize])
+			if m > 0 {
+				pos += w.sealData(w.buf[pos:], w.buf[pos+hdr:pos+hdr+m], true)
+				n += int64(m)
+			}
+			if rerr != nil || m < w.frameSize {
+				break
+			}
+		}
+		if err = w.flush(w.buf[:pos]); err != nil {
+			return
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// WriteFrame 发送一个非数据帧, payload 不能超过单帧大小
+func (w *SecureWriter) WriteFrame(typ FrameType, payload []byte) error {
+	if w.inner == nil {
+		return io.ErrClosedPipe
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if typ == FrameData || typ == FrameEOF || typ == FrameCompressed {
+		return fmt.Errorf("stcp: invalid frame type: %s", typ)
+	}
+	if len(payload) > w.frameSize {
+		return errors.New("stcp: frame payload too long")
+	}
+	_, err := w.writeFrame(typ, payload)
+	return err
+}
+
+// writeFrame 加密并立即发送一帧, b 超过单帧大小时只发送前 frameSize 字节
+func (w *SecureWriter) writeFrame(typ FrameType, b []byte) (n int, err error) {
+	if w.inner == nil {
+		return 0, io.ErrClosedPipe
+	}
+	if w.err != nil && w.err != errShutdown {
+		return 0, w.err
+	}
+	if len(b) > w.frameSize {
+		b = b[:w.frameSize]
+	}
+	if w.legacy {
+		return w.writeLegacyFrame(typ)
+	}
+	if typ >= FrameUserMin {
+		w.lastData.Store(time.Now().UnixNano())
+	}
+	// 单帧按实际长度获取缓冲区, 控制帧不占用整个批量写入缓冲区
+	buf := w.buf
+	if buf == nil {
+		buf = mcache.Malloc(w.headerSize + len(b) + gcmTagSize)
+		defer mcache.Free(buf)
+	}
+	if err = w.flush(buf[:w.seal(buf, typ, b)]); err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+// sealData 将 b 加密为一个数据帧, 压缩后变小时发送压缩帧
+func (w *SecureWriter) sealData(dst, b []byte, compress bool) int {
+	return w.sealDataWith(&w.sealState, w.nextNonce(), dst, b, compress)
+}
+
+func (w *SecureWriter) sealDataWith(s *sealState, nonce, dst, b []byte, compress bool) int {
+	w.lastData.Store(time.Now().UnixNano())
+	if compress && w.codec != nil && len(b) >= compressMinSize {
+		if c := w.codec.encode(s.cbuf, b); c != nil && len(c) < len(b) {
+			return w.sealWith(s, nonce, dst, FrameCompressed, c)
+		}
 	}
+	return w.sealWith(s, nonce, dst, FrameData, b)
+}
 
-	// 写入长度
-	rawLen := gcmHeaderSize + len(b) + gcmTagSize
-	binary.LittleEndian.PutUint16(w.buf[:gcmHeaderSize], uint16(rawLen-gcmHeaderSize))
+// seal 将 b 加密为一帧写入 dst, 返回帧长度
+func (w *SecureWriter) seal(dst []byte, typ FrameType, b []byte) int {
+	return w.sealWith(&w.sealState, w.nextNonce(), dst, typ, b)
+}
+
+func (w *SecureWriter) sealWith(s *sealState, nonce, dst []byte, typ FrameType, b []byte) int {
+	// 写入长度和类型
+	hdr := w.headerSize
+	rawLen := hdr + len(b) + gcmTagSize
+	w.putLen(dst, rawLen-hdr)
+	if !w.legacy {
+		dst[hdr-1] = byte(typ)
+	}
 
 	// 加密数据
-	w.gcm.Seal(w.buf[gcmHeaderSize:gcmHeaderSize], w.nextNonce(), b, nil)
+	w.gcm.Seal(dst[hdr:hdr], nonce, b, w.frameFormat.ad(s.ad[:0], dst, w.dir, w.version))
+	return rawLen
+}
 
+// flush 将 p 完整写入底层连接, 失败后帧序列已经不完整, 之后的写入都返回该错误
+func (w *SecureWriter) flush(p []byte) (err error) {
 	writen := 0
-	pos := 0
-	p := w.buf[:rawLen]
 	for len(p) > 0 {
 		if writen, err = w.inner.Write(p); err != nil {
+			w.err = err
 			return
 		}
-
-		pos += writen
 		p = p[writen:]
 	}
-
-	n = len(b)
 	return
 }
 
+// LastData 返回最近一次发送数据帧或自定义帧的时间, 不包括控制帧, 尚未发送时为零值
+func (w *SecureWriter) LastData() time.Time {
+	return unixNano(w.lastData.Load())
+}
+
+// unixNano 将 UnixNano 转换为时间, 0 为零值
+func unixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// bind 设置附加数据中的方向和协议版本, 两端需要一致
+func (w *SecureWriter) bind(dir byte, version uint8) {
+	w.dir = dir
+	w.version = version
+}
+
+// setCodec 设置压缩算法, c 为 nil 时不压缩, 两端需要一致
+func (w *SecureWriter) setCodec(c codec) {
+	w.codec = c
+}
+
+// acquire 从内存池获取帧缓冲区和压缩缓冲区
+func (w *SecureWriter) acquire() {
+	if w.buf == nil {
+		w.buf = mcache.Malloc(w.batchSize())
+	}
+	if w.codec != nil && w.cbuf == nil {
+		w.cbuf = mcache.Malloc(w.codec.maxEncodedLen(w.frameSize))
+	}
+}
+
+// release 写入完成后将缓冲区归还内存池, 并行模式下一直持有
+func (w *SecureWriter) release() {
+	if w.workers > 1 {
+		return
+	}
+	if w.buf != nil {
+		mcache.Free(w.buf)
+		w.buf = nil
+	}
+	if w.cbuf != nil {
+		mcache.Free(w.cbuf)
+		w.cbuf = nil
+	}
+}
+
+// CloseWrite 发送经过认证的 EOF 帧, 之后不能再写入数据
+func (w *SecureWriter) CloseWrite() error {
+	if w.inner == nil {
+		return io.ErrClosedPipe
+	}
+	if w.err == errShutdown {
+		return nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if _, err := w.writeFrame(FrameEOF, nil); err != nil {
+		return err
+	}
+	w.err = errShutdown
+	return nil
+}
+
 func NewSecureWriter(inner io.Writer, aead cipher.AEAD, nonce []byte) *SecureWriter {
+	return NewSecureWriterSize(inner, aead, nonce, gcmPacketSize)
+}
+
+// NewSecureWriterSize 创建单帧最大明文长度为 frameSize 的 SecureWriter
+func NewSecureWriterSize(inner io.Writer, aead cipher.AEAD, nonce []byte, frameSize int) *SecureWriter {
+	f := newFrameFormat(frameSize)
 	w := &SecureWriter{
-		inner: inner,
-		gcm:   aead,
-		buf:   mcache.Malloc(gcmPacketCache),
+		inner:       inner,
+		gcm:         aead,
+		frameFormat: f,
 	}
 	w.nonceSize = aead.NonceSize()
 	copy(w.nonceBase[idSizeV1:], nonce[idSizeV1:])
@@ -2,11 +2,14 @@ package stcp
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -133,6 +136,68 @@ func TestSecure(t *testing.T) {
 		assert.Equal(t, n, 0)
 	})
 
+	t.Run("write error is sticky", func(t *testing.T) {
+		w := newWriter(key, nonce[:nonceSize])
+		defer w.Close()
+		errWrite := errors.New("write error")
+		failed := false
+		mockW.writerFn = func(p []byte) (n int, err error) {
+			if !failed {
+				failed = true
+				return 0, errWrite
+			}
+			return mockW.writer.Write(p)
+		}
+		_, err := w.Write(wbuf[:16])
+		require.ErrorIs(t, err, errWrite)
+
+		// 帧序列已经不完整, 之后的写入都返回该错误
+		_, err = w.Write(wbuf[:16])
+		assert.ErrorIs(t, err, errWrite)
+		assert.ErrorIs(t, w.WriteFrame(FrameUserMin, nil), errWrite)
+		assert.ErrorIs(t, w.CloseWrite(), errWrite)
+		assert.Empty(t, mockW.Bytes())
+	})
+
+	t.Run("read error is sticky", func(t *testing.T) {
+		w := newWriter(key, nonce[:nonceSize])
+		defer w.Close()
+		_, err := w.Write(wbuf[:16])
+		require.NoError(t, err)
+		_, err = w.Write(wbuf[16:32])
+		require.NoError(t, err)
+
+		r := newReader(mockW.Bytes(), key, nonce[:nonceSize])
+		defer r.Close()
+		// 第一帧前读取超时, 第二帧读到一半时超时
+		calls := 0
+		mockR.readerFn = func(p []byte) (int, error) {
+			calls++
+			switch calls {
+			case 1:
+				return 0, os.ErrDeadlineExceeded
+			case 4:
+				return mockR.reader.Read(p[:1])
+			case 5:
+				return 0, os.ErrDeadlineExceeded
+			}
+			return mockR.reader.Read(p)
+		}
+
+		// 没有读到任何数据时可以重试
+		_, err = r.Read(rbuf)
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		n, err := r.Read(rbuf)
+		require.NoError(t, err)
+		assert.Equal(t, wbuf[:16], rbuf[:n])
+
+		// 帧读取到一半, 之后的读取都返回该错误
+		_, err = r.Read(rbuf)
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		_, err = r.Read(rbuf)
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+
 	t.Run("test nonceId overflow", func(t *testing.T) {
 		nonce1 := [maxNonceSize]byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
 		copy(nonce1[idSizeV1:], nonce[idSizeV1:])
@@ -165,6 +230,13 @@ func TestSecure(t *testing.T) {
 		w.inner = nil
 		_, err = w.Write([]byte{})
 		assert.ErrorAs(t, err, &io.ErrClosedPipe)
+
+		// CloseWrite 之后关闭, 控制帧同样返回 io.ErrClosedPipe
+		w = newWriter(key, nonce[:nonceSize])
+		require.NoError(t, w.CloseWrite())
+		w.Close()
+		_, err = w.writeFrame(FramePing, nil)
+		assert.ErrorIs(t, err, io.ErrClosedPipe)
 	})
 
 	t.Run("test read error", func(t *testing.T) {
@@ -178,10 +250,10 @@ func TestSecure(t *testing.T) {
 		_, err = r.Read([]byte{})
 		assert.ErrorAs(t, err, &io.ErrClosedPipe)
 
-		// read EOF
+		// 没有 EOF 帧直接结束, 视为截断
 		r = newReader([]byte{}, key, nonce[:nonceSize])
 		_, err = r.Read([]byte{})
-		assert.ErrorAs(t, err, &io.EOF)
+		assert.ErrorIs(t, err, ErrTruncated)
 
 		wbuf1 := make([]byte, 128)
 		rbuf1 := make([]byte, 1024)
@@ -189,7 +261,7 @@ func TestSecure(t *testing.T) {
 		// length zero
 		r = newReader(wbuf1, key, nonce[:nonceSize])
 		_, err = r.Read(rbuf1)
-		assert.ErrorAs(t, err, &io.EOF)
+		assert.Contains(t, err.Error(), "message too short")
 
 		// message too long
 		binary.LittleEndian.PutUint16(wbuf1, gcmPacketCache)
@@ -216,3 +288,289 @@ func TestSecure(t *testing.T) {
 		assert.Contains(t, err.Error(), "cipher")
 	})
 }
+
+func TestSecureCloseWrite(t *testing.T) {
+	key := make([]byte, 32)
+	io.ReadFull(rand.Reader, key)
+	nonce := make([]byte, gcmNonceSize)
+	io.ReadFull(rand.Reader, nonce)
+
+	newPair := func() (*SecureWriter, *bytes.Buffer, cipher.AEAD) {
+		aead, err := newAES256GCM(key)
+		require.NoError(t, err)
+		buf := bytes.NewBuffer(nil)
+		w := NewSecureWriter(&mockBuffer{writer: buf}, aead, nonce)
+		aead, err = newAES256GCM(key)
+		require.NoError(t, err)
+		return w, buf, aead
+	}
+
+	t.Run("clean eof", func(t *testing.T) {
+		w, buf, aead := newPair()
+		defer w.Close()
+		_, err := w.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, w.CloseWrite())
+		require.NoError(t, w.CloseWrite())
+		_, err = w.Write([]byte("world"))
+		assert.ErrorIs(t, err, errShutdown)
+
+		r := NewSecureReader(bytes.NewReader(buf.Bytes()), aead, nonce)
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+		_, err = r.Read(make([]byte, 16))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		w, buf, aead := newPair()
+		defer w.Close()
+		_, err := w.Write([]byte("hello"))
+		require.NoError(t, err)
+
+		r := NewSecureReader(bytes.NewReader(buf.Bytes()), aead, nonce)
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		assert.ErrorIs(t, err, ErrTruncated)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		assert.Equal(t, "hello", string(data))
+	})
+
+	t.Run("forged eof", func(t *testing.T) {
+		w, buf, aead := newPair()
+		defer w.Close()
+		require.NoError(t, w.CloseWrite())
+		// 篡改帧类型, 认证失败
+		p := buf.Bytes()
+		p[2] = byte(FrameData)
+
+		r := NewSecureReader(bytes.NewReader(p), aead, nonce)
+		defer r.Close()
+		_, err := r.Read(make([]byte, 16))
+		assert.ErrorContains(t, err, "cipher")
+	})
+
+	t.Run("unknown frame type", func(t *testing.T) {
+		w, buf, aead := newPair()
+		defer w.Close()
+		require.NoError(t, w.WriteFrame(FrameUserMin, []byte("hello")))
+
+		r := NewSecureReader(bytes.NewReader(buf.Bytes()), aead, nonce)
+		defer r.Close()
+		_, err := r.Read(make([]byte, 16))
+		assert.ErrorContains(t, err, "unknown frame type")
+	})
+}
+
+func TestSecureFrameSize(t *testing.T) {
+	key := make([]byte, 32)
+	io.ReadFull(rand.Reader, key)
+	nonce := make([]byte, gcmNonceSize)
+	io.ReadFull(rand.Reader, nonce)
+
+	data := make([]byte, 300*1024)
+	io.ReadFull(rand.Reader, data)
+
+	for _, frameSize := range []int{gcmPacketSize, 64 * 1024, 256 * 1024} {
+		aead, err := newAES256GCM(key)
+		require.NoError(t, err)
+		buf := bytes.NewBuffer(nil)
+		w := NewSecureWriterSize(buf, aead, nonce, frameSize)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.CloseWrite())
+		w.Close()
+
+		f := newFrameFormat(frameSize)
+		frames := int(math.Ceil(float64(len(data))/float64(frameSize))) + 1
+		assert.Equal(t, len(data)+frames*(f.headerSize+gcmTagSize), buf.Len())
+		if frameSize+gcmTagSize > math.MaxUint16 {
+			assert.Equal(t, gcmWideHeaderSize, f.headerSize)
+		} else {
+			assert.Equal(t, gcmHeaderSize, f.headerSize)
+		}
+
+		aead, err = newAES256GCM(key)
+		require.NoError(t, err)
+		r := NewSecureReaderSize(bytes.NewReader(buf.Bytes()), aead, nonce, frameSize)
+		got, err := io.ReadAll(r)
+		r.Close()
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+	}
+
+	// 读端的单帧大小小于写端时拒绝
+	aead, err := newAES256GCM(key)
+	require.NoError(t, err)
+	buf := bytes.NewBuffer(nil)
+	w := NewSecureWriterSize(buf, aead, nonce, 16*1024)
+	defer w.Close()
+	_, err = w.Write(data[:16*1024])
+	require.NoError(t, err)
+	r := NewSecureReader(bytes.NewReader(buf.Bytes()), aead, nonce)
+	defer r.Close()
+	_, err = r.Read(make([]byte, 16))
+	assert.ErrorContains(t, err, "message too long")
+}
+
+func TestSecureBatch(t *testing.T) {
+	key := make([]byte, 32)
+	io.ReadFull(rand.Reader, key)
+	nonce := make([]byte, gcmNonceSize)
+	io.ReadFull(rand.Reader, nonce)
+
+	data := make([]byte, 1024*1024)
+	io.ReadFull(rand.Reader, data)
+
+	tests := []struct {
+		frameSize int
+		maxBatch  int
+	}{
+		{gcmPacketSize, 0},
+		{gcmPacketSize, 10000},
+		{gcmPacketSize, 100},
+		{256 * 1024, 0},
+	}
+	for _, tt := range tests {
+		aead, err := newAES256GCM(key)
+		require.NoError(t, err)
+		buf := bytes.NewBuffer(nil)
+		var writes []int
+		mockW := &mockBuffer{writerFn: func(p []byte) (int, error) {
+			writes = append(writes, len(p))
+			return buf.Write(p)
+		}}
+		w := NewSecureWriterSize(mockW, aead, nonce, tt.frameSize)
+		w.maxBatch = tt.maxBatch
+		n, err := w.Write(data)
+		w.Close()
+		require.NoError(t, err)
+		assert.Equal(t, len(data), n)
+
+		// 每次写入包含整数个完整帧
+		f := newFrameFormat(tt.frameSize)
+		frameCount := len(data) / tt.frameSize
+		limit := f.batchSize()
+		if tt.maxBatch > 0 {
+			limit = min(limit, tt.maxBatch)
+		}
+		perWrite := max(limit/f.cacheSize(), 1)
+		assert.Len(t, writes, (frameCount+perWrite-1)/perWrite)
+		for _, l := range writes {
+			assert.Zero(t, l%f.cacheSize())
+		}
+
+		aead, err = newAES256GCM(key)
+		require.NoError(t, err)
+		r := NewSecureReaderSize(bytes.NewReader(buf.Bytes()), aead, nonce, tt.frameSize)
+		got := make([]byte, len(data))
+		_, err = io.ReadFull(r, got)
+		r.Close()
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+	}
+}
+
+func TestSecureReadDirect(t *testing.T) {
+	key := make([]byte, 32)
+	io.ReadFull(rand.Reader, key)
+	nonce := make([]byte, gcmNonceSize)
+	io.ReadFull(rand.Reader, nonce)
+
+	data := make([]byte, 3*gcmPacketSize+100)
+	io.ReadFull(rand.Reader, data)
+
+	aead, err := newAES256GCM(key)
+	require.NoError(t, err)
+	buf := bytes.NewBuffer(nil)
+	w := NewSecureWriter(buf, aead, nonce)
+	defer w.Close()
+	_, err = w.Write(data)
+	require.NoError(t, err)
+
+	aead, err = newAES256GCM(key)
+	require.NoError(t, err)
+	r := NewSecureReader(bytes.NewReader(buf.Bytes()), aead, nonce)
+	defer r.Close()
+
+	// 缓冲区足够大时每次读取一整帧, 不经过内部缓冲区
+	big := make([]byte, 2*gcmPacketSize)
+	n, err := r.Read(big)
+	require.NoError(t, err)
+	assert.Equal(t, gcmPacketSize, n)
+	assert.Equal(t, data[:n], big[:n])
+	assert.Zero(t, r.readn)
+
+	// 小缓冲区从内部缓冲区按偏移读取剩余数据
+	small := make([]byte, 1000)
+	pos := n
+	for pos < 2*gcmPacketSize {
+		n, err = r.Read(small)
+		require.NoError(t, err)
+		assert.Equal(t, data[pos:pos+n], small[:n])
+		pos += n
+	}
+	assert.Zero(t, r.readn)
+
+	rest, err := io.ReadAll(r)
+	assert.ErrorIs(t, err, ErrTruncated)
+	assert.Equal(t, data[pos:], rest)
+}
+
+func BenchmarkSecure(b *testing.B) {
+	key := make([]byte, 32)
+	io.ReadFull(rand.Reader, key)
+	nonce := make([]byte, maxNonceSize)
+	io.ReadFull(rand.Reader, nonce)
+	data := make([]byte, 1024*1024)
+	io.ReadFull(rand.Reader, data)
+
+	for _, cryptoType := range []string{CryptoAES256GCM, CryptoChacha20Poly1305, CryptoXChacha20Poly1305} {
+		newCrypto, nonceSize, err := cryptoFromName(cryptoType)
+		require.NoError(b, err)
+		for _, frameSize := range []int{4 * 1024, 16 * 1024, 64 * 1024, 256 * 1024} {
+			name := fmt.Sprintf("%s/%dK", cryptoType, frameSize/1024)
+
+			b.Run(name+"/write", func(b *testing.B) {
+				aead, err := newCrypto(key)
+				require.NoError(b, err)
+				w := NewSecureWriterSize(io.Discard, aead, nonce[:nonceSize], frameSize)
+				defer w.Close()
+				b.SetBytes(int64(len(data)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := w.Write(data); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			b.Run(name+"/read", func(b *testing.B) {
+				aead, err := newCrypto(key)
+				require.NoError(b, err)
+				buf := bytes.NewBuffer(nil)
+				w := NewSecureWriterSize(buf, aead, nonce[:nonceSize], frameSize)
+				defer w.Close()
+				_, err = w.Write(data)
+				require.NoError(b, err)
+				sealed := buf.Bytes()
+
+				rbuf := make([]byte, frameSize)
+				b.SetBytes(int64(len(data)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					aead, _ := newCrypto(key)
+					r := NewSecureReaderSize(bytes.NewReader(sealed), aead, nonce[:nonceSize], frameSize)
+					for {
+						if _, err := r.Read(rbuf); err != nil {
+							break
+						}
+					}
+					r.Close()
+				}
+			})
+		}
+	}
+}
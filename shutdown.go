@@ -0,0 +1,165 @@
+package stcp
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrServerClosed 表示 ServerContext 正在关闭, 不再接受新的握手
+var ErrServerClosed = errors.New("stcp: server closed")
+
+// liveSet 服务端的监听器和连接, 用于 Shutdown
+type liveSet struct {
+	mu        sync.Mutex
+	listeners map[*listener]struct{}
+	conns     map[*Conn]struct{}
+	shutdown  bool
+	drained   chan struct{} // Shutdown 后所有连接关闭时关闭
+}
+
+func (ctx *ServerContext) trackListener(l *listener) {
+	s := &ctx.live
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[*listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+}
+
+func (ctx *ServerContext) untrackListener(l *listener) {
+	s := &ctx.live
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+}
+
+// trackConn 记录服务端连接, 关闭时删除
+func (ctx *ServerContext) trackConn(c *Conn) {
+	s := &ctx.live
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[*Conn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	c.onClose = append(c.onClose, func() { ctx.untrackConn(c) })
+}
+
+func (ctx *ServerContext) untrackConn(c *Conn) {
+	s := &ctx.live
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+	s.checkDrained()
+}
+
+// checkDrained 调用方需持有 s.mu
+func (s *liveSet) checkDrained() {
+	if s.drained == nil || len(s.conns) > 0 {
+		return
+	}
+	select {
+	case <-s.drained:
+	default:
+		close(s.drained)
+	}
+}
+
+func (ctx *ServerContext) shuttingDown() bool {
+	s := &ctx.live
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdown
+}
+
+// Shutdown 优雅关闭: 关闭所有监听器, 向每个连接发送 GoAway 帧并等待对端关闭,
+// 尚未完成握手的连接直接关闭; sctx 结束时以 ErrServerClosed 强制关闭剩余的连接并返回 sctx.Err()
+// 所有连接关闭后释放 Shutdown 持有的引用, 没有其他引用时关闭 ServerContext
+func (ctx *ServerContext) Shutdown(sctx context.Context) error {
+	// ServerContext 已关闭时不再持有引用, 仍然关闭剩余的连接
+	if ctx.Retain() == nil {
+		defer ctx.Release()
+	}
+
+	s := &ctx.live
+	s.mu.Lock()
+	s.shutdown = true
+	if s.drained == nil {
+		s.drained = make(chan struct{})
+	}
+	listeners := make([]*listener, 0, len(s.listeners))
+	for l := range s.listeners {
+		listeners = append(listeners, l)
+	}
+	s.mu.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+	for _, c := range ctx.liveConns() {
+		go c.goAway()
+	}
+
+	s.mu.Lock()
+	s.checkDrained()
+	s.mu.Unlock()
+	select {
+	case <-s.drained:
+		return nil
+	case <-sctx.Done():
+	}
+	for _, c := range ctx.liveConns() {
+		c.closeWith(ErrServerClosed)
+	}
+	return sctx.Err()
+}
+
+func (ctx *ServerContext) liveConns() []*Conn {
+	s := &ctx.live
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns := make([]*Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// GoAway 返回的通道在对端发送 GoAway 帧或服务端开始 Shutdown 时关闭, 此时应尽快结束会话并关闭连接
+// 控制帧在 Read 时处理, 客户端需要持续读取才能收到通知
+func (c *Conn) GoAway() <-chan struct{} {
+	return c.goAwayCh
+}
+
+func (c *Conn) closeGoAway() {
+	c.goAwayOnce.Do(func() {
+		if c.goAwayCh != nil {
+			close(c.goAwayCh)
+		}
+	})
+}
+
+// goAway 向对端发送 GoAway 帧, 尚未完成握手的连接直接关闭
+func (c *Conn) goAway() {
+	if !c.handshakeComplete.Load() {
+		c.Close()
+		return
+	}
+	c.closeGoAway()
+	c.out.Lock()
+	defer c.out.Unlock()
+	if c.closed.Load() || c.writeClosed {
+		return
+	}
+	if err := c.flush(); err != nil {
+		return
+	}
+	c.gcmWriter.writeFrame(FrameGoAway, nil)
+}
+
+func (c *Conn) handleGoAway([]byte) error {
+	c.closeGoAway()
+	return nil
+}
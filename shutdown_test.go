@@ -0,0 +1,101 @@
+package stcp
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdown(t *testing.T) {
+	// newServer 返回监听器和完成握手的服务端连接, 服务端连接读到 EOF 后关闭
+	newServer := func(t *testing.T) (net.Listener, *ClientConfig, *ServerContext, chan *Conn) {
+		clientConfig, serverCtx := newTestConfig(t)
+		ln, err := Listen("tcp", "127.0.0.1:0", serverCtx)
+		require.NoError(t, err)
+		t.Cleanup(func() { ln.Close() })
+		accepted := make(chan *Conn, 1)
+		go func() {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn := c.(*Conn)
+			if conn.Handshake() != nil {
+				return
+			}
+			accepted <- conn
+			io.Copy(io.Discard, conn)
+			conn.Close()
+		}()
+		return ln, clientConfig, serverCtx, accepted
+	}
+
+	t.Run("drain", func(t *testing.T) {
+		ln, clientConfig, serverCtx, accepted := newServer(t)
+		client, err := Dial("tcp", ln.Addr().String(), clientConfig)
+		require.NoError(t, err)
+		defer client.Close()
+		server := <-accepted
+
+		// 客户端收到 GoAway 后关闭连接
+		go func() {
+			go io.Copy(io.Discard, client)
+			<-client.GoAway()
+			client.Close()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		require.NoError(t, serverCtx.Shutdown(ctx))
+		assert.True(t, server.closed.Load())
+		assert.False(t, serverCtx.running.Load())
+
+		_, err = ln.Accept()
+		assert.Error(t, err)
+		_, err = net.Dial("tcp", ln.Addr().String())
+		assert.Error(t, err)
+	})
+
+	t.Run("force close", func(t *testing.T) {
+		ln, clientConfig, serverCtx, accepted := newServer(t)
+		client, err := Dial("tcp", ln.Addr().String(), clientConfig)
+		require.NoError(t, err)
+		defer client.Close()
+		server := <-accepted
+		clientErr := make(chan error, 1)
+		go func() {
+			_, err := io.Copy(io.Discard, client)
+			clientErr <- err
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, serverCtx.Shutdown(ctx), context.DeadlineExceeded)
+		assert.True(t, server.closed.Load())
+		// 对端收到关闭原因
+		assert.ErrorIs(t, <-clientErr, ErrServerClosed)
+		select {
+		case <-server.GoAway():
+		default:
+			t.Fatal("server conn not notified")
+		}
+	})
+
+	t.Run("handshake", func(t *testing.T) {
+		_, serverCtx := newTestConfig(t)
+		c, s := net.Pipe()
+		defer c.Close()
+		// 尚未完成握手的连接直接关闭
+		server := Server(s, serverCtx)
+		require.NoError(t, serverCtx.Shutdown(context.Background()))
+		assert.True(t, server.closed.Load())
+
+		c, s = net.Pipe()
+		defer c.Close()
+		assert.ErrorIs(t, Server(s, serverCtx).Handshake(), ErrServerClosed)
+	})
+}
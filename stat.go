@@ -1,49 +1,345 @@
 package stcp
 
 import (
-	"context"
+	"fmt"
 	"net"
+	"os"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"golang.org/x/time/rate"
 )
 
+// Stat 统计底层连接的读写字节数, 并按限速器限制读写速度
+// 限速等待受读写截止时间约束, 可以被 Close 打断
 type Stat struct {
 	net.Conn
 
 	rn int64
 	wn int64
+	// 限速累计等待时间, 纳秒
+	rWait int64
+	wWait int64
 
-	rL *rate.Limiter
-	wL *rate.Limiter
+	// 读写限速器, 每次读写需要同时满足所有限速器
+	rL limitSet
+	wL limitSet
+	// 服务端按客户端公钥统计的流量
+	usage *keyUsage
+
+	mu        sync.Mutex
+	rDeadline deadline
+	wDeadline deadline
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// limitSet 一个方向的限速器
+type limitSet struct {
+	// 连接独占或按公钥共享的限速器, 同时预留
+	ls []*rate.Limiter
+	// 多个连接共享的限速器, 按权重公平排队
+	fair []*fairFlow
+}
+
+// empty 返回是否所有限速器都不限速, 限速器可能被修改, 每次读写时检查
+func (l limitSet) empty() bool {
+	for _, x := range l.ls {
+		if x.Limit() != rate.Inf {
+			return false
+		}
+	}
+	for _, f := range l.fair {
+		if f.q.l.Limit() != rate.Inf {
+			return false
+		}
+	}
+	return true
+}
+
+// burst 返回所有限速器中最小的突发值, 都不限速时返回 0
+func (l limitSet) burst() int {
+	n := minBurst(l.ls)
+	for _, f := range l.fair {
+		if b := minBurst([]*rate.Limiter{f.q.l}); b > 0 && (n == 0 || b < n) {
+			n = b
+		}
+	}
+	return n
+}
+
+// deadline 记录截止时间, 修改时关闭 changed 通知正在等待的协程
+type deadline struct {
+	t       time.Time
+	changed chan struct{}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.t = t
+	if d.changed != nil {
+		close(d.changed)
+	}
+	d.changed = make(chan struct{})
 }
 
 func WrapStat(c net.Conn) *Stat {
-	return &Stat{
+	s := &Stat{
 		Conn: c,
+		done: make(chan struct{}),
 	}
+	s.rDeadline.changed = make(chan struct{})
+	s.wDeadline.changed = make(chan struct{})
+	return s
 }
 
 func (s *Stat) Read(p []byte) (n int, err error) {
+	if s.rL.empty() {
+		n, err = s.Conn.Read(p)
+		s.count(n, false)
+		return
+	}
+
+	// 单次读取不超过突发值, 读取后按实际长度等待
+	if b := s.rL.burst(); b > 0 && len(p) > b {
+		p = p[:b]
+	}
 	n, err = s.Conn.Read(p)
-	if n > 0 && s.rL != nil {
-		s.rL.WaitN(context.Background(), n)
+	s.count(n, false)
+	if n > 0 {
+		if werr := s.wait(s.rL, n, &s.rDeadline, &s.rWait, false); werr != nil && err == nil {
+			err = werr
+		}
 	}
-	atomic.AddInt64(&s.rn, int64(n))
 	return
 }
 
 func (s *Stat) Write(p []byte) (n int, err error) {
-	n, err = s.Conn.Write(p)
-	if n > 0 && s.wL != nil {
-		s.wL.WaitN(context.Background(), n)
+	if s.wL.empty() {
+		n, err = s.Conn.Write(p)
+		s.count(n, true)
+		return
+	}
+
+	// 按突发值分段, 每段等待后再写入
+	for len(p) > 0 {
+		k := len(p)
+		if b := s.wL.burst(); b > 0 && k > b {
+			k = b
+		}
+		if err = s.wait(s.wL, k, &s.wDeadline, &s.wWait, true); err != nil {
+			return
+		}
+		var m int
+		m, err = s.Conn.Write(p[:k])
+		n += m
+		s.count(m, true)
+		if err != nil {
+			return
+		}
+		p = p[k:]
 	}
-	atomic.AddInt64(&s.wn, int64(n))
 	return
 }
 
+func (s *Stat) count(n int, write bool) {
+	if write {
+		atomic.AddInt64(&s.wn, int64(n))
+	} else {
+		atomic.AddInt64(&s.rn, int64(n))
+	}
+	if s.usage != nil {
+		s.usage.add(n, write)
+	}
+}
+
+// wait 按所有限速器等待 n 字节, 超过突发值时分段
+// 超过截止时间返回 os.ErrDeadlineExceeded, 连接关闭返回 net.ErrClosed
+// refund 为 true 时中断的等待会归还预留的额度
+func (s *Stat) wait(l limitSet, n int, d *deadline, total *int64, refund bool) error {
+	for n > 0 {
+		k := n
+		if b := l.burst(); b > 0 && k > b {
+			k = b
+		}
+		if err := s.waitN(l.ls, k, d, total, refund); err != nil {
+			return err
+		}
+		for _, f := range l.fair {
+			if err := s.waitFair(f, k, d, total, refund); err != nil {
+				return err
+			}
+		}
+		n -= k
+	}
+	return nil
+}
+
+// waitN 从所有限速器预留 n 字节, 等待其中最长的延迟, 不限速的限速器不预留
+func (s *Stat) waitN(ls []*rate.Limiter, n int, d *deadline, total *int64, refund bool) error {
+	now := time.Now()
+	var rs []*rate.Reservation
+	cancel := func() {
+		if refund {
+			for _, r := range rs {
+				r.Cancel()
+			}
+		}
+	}
+	var delay time.Duration
+	for _, l := range ls {
+		if l.Limit() == rate.Inf {
+			continue
+		}
+		r := l.ReserveN(now, n)
+		if !r.OK() {
+			cancel()
+			return fmt.Errorf("stcp: rate limiter burst %d less than %d", l.Burst(), n)
+		}
+		rs = append(rs, r)
+		delay = max(delay, r.DelayFrom(now))
+	}
+	if delay <= 0 {
+		return nil
+	}
+
+	ready := make(chan struct{})
+	timer := time.AfterFunc(delay, func() { close(ready) })
+	defer timer.Stop()
+	defer func() {
+		atomic.AddInt64(total, int64(time.Since(now)))
+	}()
+	if err := s.block(ready, d); err != nil {
+		cancel()
+		return err
+	}
+	return nil
+}
+
+// waitFair 在共享限速器上排队, 轮到后按限速器等待, 等待结束后放行下一个请求
+func (s *Stat) waitFair(f *fairFlow, n int, d *deadline, total *int64, refund bool) error {
+	q := f.q
+	if q.l.Limit() == rate.Inf {
+		return nil
+	}
+	now := time.Now()
+	req := q.push(f, n)
+	if err := s.block(req.ready, d); err != nil {
+		q.cancel(req)
+		return err
+	}
+	atomic.AddInt64(total, int64(time.Since(now)))
+	defer q.release(f)
+	return s.waitN([]*rate.Limiter{q.l}, n, d, total, refund)
+}
+
+// block 等待 ready 关闭, 超过截止时间返回 os.ErrDeadlineExceeded, 连接关闭返回 net.ErrClosed
+func (s *Stat) block(ready <-chan struct{}, d *deadline) error {
+	for {
+		select {
+		case <-ready:
+			return nil
+		default:
+		}
+		s.mu.Lock()
+		t, changed := d.t, d.changed
+		s.mu.Unlock()
+
+		var expired <-chan time.Time
+		var dt *time.Timer
+		if !t.IsZero() {
+			left := time.Until(t)
+			if left <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			dt = time.NewTimer(left)
+			expired = dt.C
+		}
+
+		var err error
+		done := true
+		select {
+		case <-ready:
+		case <-s.done:
+			err = net.ErrClosed
+		case <-expired:
+			done = false
+		case <-changed:
+			done = false
+		}
+		// 每轮结束时停止计时器, 截止时间多次修改时不会累积
+		if dt != nil {
+			dt.Stop()
+		}
+		if done {
+			return err
+		}
+	}
+}
+
+func (s *Stat) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.rDeadline.set(t)
+	s.wDeadline.set(t)
+	s.mu.Unlock()
+	return s.Conn.SetDeadline(t)
+}
+
+func (s *Stat) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.rDeadline.set(t)
+	s.mu.Unlock()
+	return s.Conn.SetReadDeadline(t)
+}
+
+func (s *Stat) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.wDeadline.set(t)
+	s.mu.Unlock()
+	return s.Conn.SetWriteDeadline(t)
+}
+
+// tempWriteDeadline 临时将写截止时间提前到 t, 返回的函数恢复原来的截止时间
+// 期间截止时间被修改过时不恢复
+func (s *Stat) tempWriteDeadline(t time.Time) (restore func()) {
+	s.mu.Lock()
+	prev := s.wDeadline.t
+	if !prev.IsZero() && prev.Before(t) {
+		s.mu.Unlock()
+		return func() {}
+	}
+	s.wDeadline.set(t)
+	changed := s.wDeadline.changed
+	s.mu.Unlock()
+	s.Conn.SetWriteDeadline(t)
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.wDeadline.changed != changed {
+			return
+		}
+		s.wDeadline.set(prev)
+		s.Conn.SetWriteDeadline(prev)
+	}
+}
+
+// Close 关闭底层连接, 并打断正在进行的限速等待
+func (s *Stat) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return s.Conn.Close()
+}
+
 func (s *Stat) Total() (rn, wn int64) {
 	rn = atomic.LoadInt64(&s.rn)
 	wn = atomic.LoadInt64(&s.wn)
 	return
 }
+
+// Waited 返回读写因限速累计等待的时间
+func (s *Stat) Waited() (rw, ww time.Duration) {
+	rw = time.Duration(atomic.LoadInt64(&s.rWait))
+	ww = time.Duration(atomic.LoadInt64(&s.wWait))
+	return
+}
@@ -0,0 +1,105 @@
+package stcp
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func newTestStat(t *testing.T, l *rate.Limiter) *Stat {
+	t.Helper()
+	c, peer := net.Pipe()
+	go io.Copy(io.Discard, peer)
+	t.Cleanup(func() { peer.Close() })
+	s := WrapStat(c)
+	s.rL.ls, s.wL.ls = limiters(l), limiters(l)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStatLimit(t *testing.T) {
+	t.Run("split burst", func(t *testing.T) {
+		s := newTestStat(t, rate.NewLimiter(100*1024, 1024))
+		n, err := s.Write(make([]byte, 10*1024))
+		require.NoError(t, err)
+		assert.Equal(t, 10*1024, n)
+		_, wn := s.Total()
+		assert.EqualValues(t, 10*1024, wn)
+		_, ww := s.Waited()
+		assert.Greater(t, ww, 50*time.Millisecond)
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		s := newTestStat(t, rate.NewLimiter(1024, 1024))
+		_, err := s.Write(make([]byte, 1024))
+		require.NoError(t, err)
+
+		require.NoError(t, s.SetWriteDeadline(time.Now().Add(50*time.Millisecond)))
+		start := time.Now()
+		_, err = s.Write(make([]byte, 1024))
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+	})
+
+	t.Run("deadline changed", func(t *testing.T) {
+		s := newTestStat(t, rate.NewLimiter(1024, 1024))
+		_, err := s.Write(make([]byte, 1024))
+		require.NoError(t, err)
+
+		time.AfterFunc(50*time.Millisecond, func() {
+			s.SetWriteDeadline(time.Now())
+		})
+		start := time.Now()
+		_, err = s.Write(make([]byte, 1024))
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		s := newTestStat(t, rate.NewLimiter(1024, 1024))
+		_, err := s.Write(make([]byte, 1024))
+		require.NoError(t, err)
+
+		time.AfterFunc(50*time.Millisecond, func() {
+			s.Close()
+		})
+		start := time.Now()
+		_, err = s.Write(make([]byte, 1024))
+		assert.ErrorIs(t, err, net.ErrClosed)
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+	})
+}
+
+// TestConnLimitClose 限速等待中的 Read 可以被 Close 打断
+func TestConnLimitClose(t *testing.T) {
+	clientConfig, serverCtx := newTestConfig(t)
+	serverCtx.ReadLimiter = rate.NewLimiter(1024, 8*1024)
+	client, server, err := newTestConns(t, clientConfig, serverCtx)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// 随机数据不可压缩, 按原始长度限速
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+	go client.Write(data)
+	buf := make([]byte, 64*1024)
+	_, err = io.ReadFull(server, buf[:8*1024])
+	require.NoError(t, err)
+
+	time.AfterFunc(50*time.Millisecond, func() {
+		server.Close()
+	})
+	start := time.Now()
+	_, err = io.ReadFull(server, buf)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+	rw, _ := server.LimitWait()
+	assert.Greater(t, rw, time.Duration(0))
+}
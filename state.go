@@ -0,0 +1,94 @@
+package stcp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/taodev/stcp/key"
+)
+
+// ConnectionState 记录连接握手协商得到的信息
+type ConnectionState struct {
+	// 握手是否已完成, 未完成时其余字段均为零值
+	HandshakeComplete bool
+	// 协议版本
+	Version uint8
+	// 加密类型, 例如 aes-256-gcm
+	CryptoType string
+	// 对端公钥: 服务端为客户端公钥, 客户端为服务端公钥
+	PeerPublicKey []byte
+	// 对端公钥指纹, 格式与 key.Fingerprint 一致
+	PeerFingerprint string
+	// 是否为会话恢复, stcp 目前没有会话恢复, 始终为 false
+	DidResume bool
+	// 协商得到的应用层协议, 未协商时为空
+	NegotiatedProtocol string
+	// 协商得到的单帧最大明文长度
+	MaxFrameSize int
+	// 协商得到的压缩算法, 不压缩时为 none
+	Compression string
+	// 握手完成时间
+	HandshakeTime time.Time
+	// 握手耗时
+	HandshakeDuration time.Duration
+}
+
+// ConnectionState 返回连接的握手信息
+func (c *Conn) ConnectionState() ConnectionState {
+	var state ConnectionState
+	if !c.handshakeComplete.Load() {
+		return state
+	}
+	state.HandshakeComplete = true
+	state.Version = c.version
+	state.CryptoType = c.cryptoType
+	state.PeerPublicKey = bytes.Clone(c.peerKey)
+	state.PeerFingerprint = key.Fingerprint(c.peerKey)
+	state.NegotiatedProtocol = c.protocol
+	state.MaxFrameSize = c.frameSize
+	state.Compression = compressNames[c.compress]
+	state.HandshakeTime = c.handshakeTime
+	state.HandshakeDuration = c.handshakeDuration
+	return state
+}
+
+const (
+	exporterInfo = "stcp exporter"
+
+	// ChannelBindingLabel 通道绑定使用的导出标签, 与 RFC 9266 一致
+	ChannelBindingLabel = "EXPORTER-Channel-Binding"
+	channelBindingSize  = 32
+)
+
+// ExportKeyingMaterial 按 RFC 5705 的方式从握手密钥导出 length 字节的密钥材料
+// 同一连接两端使用相同的 label 和 context 得到相同结果
+// context 为 nil 和空切片视为不同的输入
+func (c *Conn) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	if !c.handshakeComplete.Load() {
+		return nil, errors.New("stcp: handshake not complete")
+	}
+	if length <= 0 {
+		return nil, errors.New("stcp: invalid keying material length")
+	}
+	// salt: [0x00] 表示无 context, [0x01][len u16][context] 表示有 context
+	salt := []byte{0x00}
+	if context != nil {
+		if len(context) > math.MaxUint16 {
+			return nil, errors.New("stcp: context too long")
+		}
+		salt = []byte{0x01}
+		salt = binary.LittleEndian.AppendUint16(salt, uint16(len(context)))
+		salt = append(salt, context...)
+	}
+	return hkdfKey(sha256.New, c.exporterSecret, salt, label, length)
+}
+
+// ChannelBinding 返回连接的通道绑定值, 两端一致且每个连接不同
+// 可用于将应用层认证绑定到当前连接, 防止令牌被转移到其他连接重放
+func (c *Conn) ChannelBinding() ([]byte, error) {
+	return c.ExportKeyingMaterial(ChannelBindingLabel, nil, channelBindingSize)
+}
@@ -0,0 +1,205 @@
+package stcp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/taodev/stcp/key"
+)
+
+func TestConnectionState(t *testing.T) {
+	t.Run("before handshake", func(t *testing.T) {
+		clientConfig, _ := newTestConfig(t)
+		c := Client(&MockConn{}, clientConfig)
+		state := c.ConnectionState()
+		assert.False(t, state.HandshakeComplete)
+		assert.Empty(t, state.PeerPublicKey)
+	})
+
+	t.Run("successful", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+
+		cs := client.ConnectionState()
+		assert.True(t, cs.HandshakeComplete)
+		assert.Equal(t, uint8(VersionV1), cs.Version)
+		assert.Equal(t, CryptoAES256GCM, cs.CryptoType)
+		assert.Equal(t, testServerPub, cs.PeerPublicKey)
+		assert.Equal(t, key.Fingerprint(testServerPub), cs.PeerFingerprint)
+		assert.False(t, cs.DidResume)
+		assert.Empty(t, cs.NegotiatedProtocol)
+		assert.Equal(t, gcmPacketSize, cs.MaxFrameSize)
+		assert.False(t, cs.HandshakeTime.IsZero())
+		assert.Greater(t, cs.HandshakeDuration, time.Duration(0))
+
+		ss := server.ConnectionState()
+		assert.True(t, ss.HandshakeComplete)
+		assert.Equal(t, testClientPub, ss.PeerPublicKey)
+		assert.Equal(t, key.Fingerprint(testClientPub), ss.PeerFingerprint)
+	})
+
+	t.Run("frame size", func(t *testing.T) {
+		tests := []struct {
+			client, server, want int
+		}{
+			{64 * 1024, 16 * 1024, 16 * 1024},
+			{16 * 1024, 256 * 1024, 16 * 1024},
+			{256 * 1024, 256 * 1024, 256 * 1024},
+			{4096, 64 * 1024, 4096},
+			{0, 0, gcmPacketSize},
+		}
+		for _, tt := range tests {
+			clientConfig, serverCtx := newTestConfig(t)
+			clientConfig.MaxFrameSize = tt.client
+			serverCtx.MaxFrameSize = tt.server
+			client, server, err := newTestConns(t, clientConfig, serverCtx)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.want, client.ConnectionState().MaxFrameSize)
+			assert.Equal(t, tt.want, server.ConnectionState().MaxFrameSize)
+
+			data := make([]byte, 3*tt.want+100)
+			rand.Read(data)
+			go func() {
+				client.Write(data)
+				client.CloseWrite()
+			}()
+			got, err := io.ReadAll(server)
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+			client.Close()
+			server.Close()
+		}
+
+		clientConfig, _ := newTestConfig(t)
+		clientConfig.MaxFrameSize = 1024
+		_, err := clientHandshake(io.Discard, clientConfig)
+		assert.ErrorContains(t, err, "invalid max frame size")
+	})
+
+	t.Run("negotiated protocol", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		clientConfig.NextProtos = []string{"smux/1", "h2"}
+		serverCtx.NextProtos = []string{"h2", "smux/1"}
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+
+		assert.Equal(t, "h2", client.ConnectionState().NegotiatedProtocol)
+		assert.Equal(t, "h2", server.ConnectionState().NegotiatedProtocol)
+
+		go client.Write([]byte("ping"))
+		buf := make([]byte, 16)
+		n, err := server.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(buf[:n]))
+	})
+
+	t.Run("server without protocols", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		clientConfig.NextProtos = []string{"h2"}
+		client, server, err := newTestConns(t, clientConfig, serverCtx)
+		require.NoError(t, err)
+		defer client.Close()
+		defer server.Close()
+
+		assert.Empty(t, client.ConnectionState().NegotiatedProtocol)
+		assert.Empty(t, server.ConnectionState().NegotiatedProtocol)
+	})
+
+	t.Run("no common protocol", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		clientConfig.NextProtos = []string{"h2"}
+		serverCtx.NextProtos = []string{"smux/1"}
+		_, _, err := newTestConns(t, clientConfig, serverCtx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no application protocol")
+	})
+}
+
+func TestHelloMsg(t *testing.T) {
+	key := make([]byte, 32)
+	m := &helloMsg{version: VersionV1, flags: helloFlagWant, protocols: []string{"h2", "smux/1"}, frameSize: 64 * 1024, compress: []uint8{compressZstd, compressNone}}
+	b, err := sealHello(key, helloClient, m)
+	require.NoError(t, err)
+
+	m1, err := openHello(bytes.NewReader(b), key, helloClient)
+	require.NoError(t, err)
+	assert.Equal(t, m, m1)
+
+	// 方向不同, 签名不一致
+	_, err = openHello(bytes.NewReader(b), key, helloServer)
+	assert.ErrorContains(t, err, "hello sign error")
+
+	// 未知扩展被忽略
+	payload := appendExt([]byte{VersionV1, 0}, 0xff, []byte("unknown"))
+	m2 := new(helloMsg)
+	require.NoError(t, m2.unmarshal(payload))
+	assert.Empty(t, m2.protocols)
+
+	assert.Error(t, m2.unmarshal([]byte{VersionV1}))
+	assert.Error(t, m2.unmarshal(append([]byte{VersionV1, 0}, extProtocols, 8, 0)))
+	assert.Error(t, m2.unmarshal(appendExt([]byte{VersionV1, 0}, extProtocols, []byte{0})))
+	assert.Error(t, m2.unmarshal(appendExt([]byte{VersionV1, 0}, extFrameSize, []byte{0})))
+
+	_, err = (&helloMsg{protocols: []string{""}}).marshal()
+	assert.Error(t, err)
+}
+
+func TestExportKeyingMaterial(t *testing.T) {
+	clientConfig, serverCtx := newTestConfig(t)
+
+	c := Client(&MockConn{}, clientConfig)
+	_, err := c.ExportKeyingMaterial("label", nil, 32)
+	assert.ErrorContains(t, err, "handshake not complete")
+
+	client, server, err := newTestConns(t, clientConfig, serverCtx)
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+
+	ekm1, err := client.ExportKeyingMaterial("label", []byte("context"), 48)
+	require.NoError(t, err)
+	assert.Len(t, ekm1, 48)
+	ekm2, err := server.ExportKeyingMaterial("label", []byte("context"), 48)
+	require.NoError(t, err)
+	assert.Equal(t, ekm1, ekm2)
+
+	other, err := client.ExportKeyingMaterial("other", []byte("context"), 48)
+	require.NoError(t, err)
+	assert.NotEqual(t, ekm1, other)
+
+	noContext, err := client.ExportKeyingMaterial("label", nil, 32)
+	require.NoError(t, err)
+	emptyContext, err := client.ExportKeyingMaterial("label", []byte{}, 32)
+	require.NoError(t, err)
+	assert.NotEqual(t, noContext, emptyContext)
+
+	_, err = client.ExportKeyingMaterial("label", nil, 0)
+	assert.Error(t, err)
+
+	cb1, err := client.ChannelBinding()
+	require.NoError(t, err)
+	cb2, err := server.ChannelBinding()
+	require.NoError(t, err)
+	assert.Equal(t, cb1, cb2)
+	assert.Len(t, cb1, channelBindingSize)
+
+	// 不同连接的通道绑定值不同
+	client1, server1, err := newTestConns(t, clientConfig, serverCtx)
+	require.NoError(t, err)
+	defer client1.Close()
+	defer server1.Close()
+	cb3, err := client1.ChannelBinding()
+	require.NoError(t, err)
+	assert.NotEqual(t, cb1, cb3)
+}
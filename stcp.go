@@ -4,14 +4,20 @@ import (
 	"context"
 	"errors"
 	"net"
+	"sync/atomic"
 )
 
 func Server(conn net.Conn, ctx *ServerContext) *Conn {
 	c := &Conn{
 		conn:      conn,
 		serverCtx: ctx,
+		stat:      WrapStat(conn),
+		goAwayCh:  make(chan struct{}),
 	}
 	c.handshakeFn = c.serverHandshake
+	if ctx != nil {
+		ctx.trackConn(c)
+	}
 	return c
 }
 
@@ -19,6 +25,8 @@ func Client(conn net.Conn, config *ClientConfig) *Conn {
 	c := &Conn{
 		conn:         conn,
 		clientConfig: config,
+		stat:         WrapStat(conn),
+		goAwayCh:     make(chan struct{}),
 	}
 	c.handshakeFn = c.clientHandshake
 	return c
@@ -26,30 +34,71 @@ func Client(conn net.Conn, config *ClientConfig) *Conn {
 
 type listener struct {
 	net.Listener
-	ctx *ServerContext
+	ctx    *ServerContext
+	pool   handshakePool
+	closed atomic.Bool
+	err    error // ACL 配置错误, Accept 时返回
 }
 
+// Accept 接受连接, 不在允许网段内、被封禁或超过 MaxConns、MaxConnsPerIP、MaxHandshakes 的连接直接关闭
+// HandshakeWorkers 大于 0 时在后台握手, 只返回握手完成的连接
 func (l *listener) Accept() (net.Conn, error) {
-	c, err := l.Listener.Accept()
-	if err != nil {
-		return nil, err
+	if l.err != nil {
+		return nil, l.err
+	}
+	if l.ctx.HandshakeWorkers > 0 {
+		return l.acceptReady()
+	}
+	return l.accept()
+}
+
+func (l *listener) accept() (*Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.ctx.allowed(c) || l.ctx.banned(c) {
+			c.Close()
+			continue
+		}
+		slot, err := l.ctx.admit(c.RemoteAddr())
+		if err != nil {
+			c.Close()
+			continue
+		}
+		conn := Server(c, l.ctx)
+		conn.slot = slot
+		conn.onClose = append(conn.onClose, slot.release)
+		return conn, nil
 	}
-	return Server(c, l.ctx), nil
 }
 
+// Close 关闭监听器并释放 ServerContext 的引用, 其他监听器仍在使用时不关闭 ServerContext
 func (l *listener) Close() error {
+	l.pool.close()
 	err := l.Listener.Close()
-	if err != nil {
-		return err
+	if l.closed.CompareAndSwap(false, true) {
+		l.ctx.untrackListener(l)
+		l.ctx.Release()
 	}
-	l.ctx.Close()
-	return nil
+	return err
 }
 
+// NewListener 创建监听器, 多个监听器可以共享同一个 ServerContext, 最后一个监听器关闭时关闭 ServerContext
+// ACL 配置错误或 ServerContext 已关闭时 Accept 返回该错误
 func NewListener(inner net.Listener, ctx *ServerContext) net.Listener {
 	l := new(listener)
 	l.Listener = inner
 	l.ctx = ctx
+	if err := ctx.Retain(); err != nil {
+		// 没有持有引用, 关闭时不释放
+		l.err = err
+		l.closed.Store(true)
+		return l
+	}
+	l.err = ctx.checkACL()
+	ctx.trackListener(l)
 	return l
 }
 
@@ -64,11 +113,19 @@ func Listen(network, address string, ctx *ServerContext) (net.Listener, error) {
 	if ctx == nil {
 		return nil, errors.New("stcp: invalid ctx")
 	}
+	if err := ctx.checkACL(); err != nil {
+		return nil, err
+	}
 	l, err := net.Listen(network, address)
 	if err != nil {
 		return nil, err
 	}
-	return NewListener(l, ctx), nil
+	ln := NewListener(l, ctx)
+	if err = ln.(*listener).err; err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
 }
 
 func DialWithDialer(dialer *net.Dialer, network, addr string, config *ClientConfig) (*Conn, error) {
@@ -233,6 +233,46 @@ func TestSTCP(t *testing.T) {
 		inR, inW, outR, outW := conn.Stat()
 		t.Logf("inR: %d, inW: %d, outR: %d, outW: %d", inR, inW, outR, outW)
 	})
+
+	t.Run("shared context", func(t *testing.T) {
+		clientConfig, serverCtx := newTestConfig(t)
+		ln1, err := Listen("tcp", "127.0.0.1:0", serverCtx)
+		require.NoError(t, err)
+		ln2, err := Listen("tcp", "127.0.0.1:0", serverCtx)
+		require.NoError(t, err)
+		defer ln2.Close()
+
+		// 关闭一个监听器不影响其他监听器
+		require.NoError(t, ln1.Close())
+		assert.Error(t, ln1.Close())
+		assert.True(t, serverCtx.running.Load())
+		go func() {
+			if c, err := ln2.Accept(); err == nil {
+				c.(*Conn).Handshake()
+				c.Close()
+			}
+		}()
+		conn, err := Dial("tcp", ln2.Addr().String(), clientConfig)
+		require.NoError(t, err)
+		conn.Close()
+
+		// 最后一个监听器关闭时关闭 ServerContext
+		require.NoError(t, serverCtx.Retain())
+		ln2.Close()
+		assert.True(t, serverCtx.running.Load())
+		serverCtx.Release()
+		assert.False(t, serverCtx.running.Load())
+
+		// 已关闭的 ServerContext 不能再使用
+		_, err = Listen("tcp", "127.0.0.1:0", serverCtx)
+		assert.ErrorIs(t, err, ErrServerClosed)
+		assert.ErrorIs(t, serverCtx.Retain(), ErrServerClosed)
+		ln := NewListener(newLocalListener(t), serverCtx)
+		_, err = ln.Accept()
+		assert.ErrorIs(t, err, ErrServerClosed)
+		assert.NoError(t, ln.Close())
+		assert.Equal(t, int64(closedRefs), serverCtx.refs.Load())
+	})
 }
 
 func isTimeoutError(err error) bool {
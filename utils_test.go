@@ -2,12 +2,15 @@ package stcp
 
 import (
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"io"
 	"net"
+	"testing"
 	"time"
 
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 type mockBuffer struct {
@@ -154,3 +157,76 @@ func (m *MockConn) Write(b []byte) (n int, err error) {
 	}
 	return m.mockBuffer.Write(b)
 }
+
+var (
+	testClientKey, _ = hex.DecodeString("bd576b064485a8b48e34dd0944dd3103ff41eb25634f9c65210878efad5ff456")
+	testClientPub, _ = hex.DecodeString("8eecad2858324bce6c6dc22d3042f8bdcdff1d7ca6505a2d1026334dbfdfcc43")
+	testServerKey, _ = hex.DecodeString("2ec32e40b1e7db6a890d2177d24062029210bab921bf74f1c4baaf3abde56a7d")
+	testServerPub, _ = hex.DecodeString("dd5a10ba96106062511848ab9cd91b1eeaf1816698950ef89bfb0cf4e19b8078")
+)
+
+func newTestConfig(t testing.TB) (*ClientConfig, *ServerContext) {
+	t.Helper()
+	clientConfig, err := NewClientConfig()
+	require.NoError(t, err)
+	clientConfig.PrivateKey = testClientKey
+	clientConfig.ServerPub = testServerPub
+
+	serverCtx, err := NewServerContext()
+	require.NoError(t, err)
+	serverCtx.PrivateKey = testServerKey
+	t.Cleanup(serverCtx.Close)
+	return clientConfig, serverCtx
+}
+
+// newTestConns 通过本地 TCP 建立一对已握手的连接
+func newTestConns(t testing.TB, clientConfig *ClientConfig, serverCtx *ServerContext) (client, server *Conn, err error) {
+	t.Helper()
+	ln := newLocalListener(t)
+	defer ln.Close()
+
+	acceptCh := make(chan net.Conn, 1)
+	go func() {
+		s, err := ln.Accept()
+		if err != nil {
+			s = nil
+		}
+		acceptCh <- s
+	}()
+	c, err := net.Dial(ln.Addr().Network(), ln.Addr().String())
+	require.NoError(t, err)
+	s := <-acceptCh
+	require.NotNil(t, s)
+	return handshakeTestConns(c, s, clientConfig, serverCtx)
+}
+
+// newTestPipe 通过 net.Pipe 建立一对已握手的连接, 写入在对端读取前会一直阻塞
+func newTestPipe(t testing.TB, clientConfig *ClientConfig, serverCtx *ServerContext) (client, server *Conn, err error) {
+	t.Helper()
+	c, s := net.Pipe()
+	return handshakeTestConns(c, s, clientConfig, serverCtx)
+}
+
+func handshakeTestConns(c, s net.Conn, clientConfig *ClientConfig, serverCtx *ServerContext) (client, server *Conn, err error) {
+	client = Client(c, clientConfig)
+	server = Server(s, serverCtx)
+	errCh := make(chan error, 1)
+	go func() {
+		err := server.Handshake()
+		if err != nil {
+			server.Close()
+		}
+		errCh <- err
+	}()
+	if err = client.Handshake(); err != nil {
+		client.Close()
+	}
+	if serr := <-errCh; serr != nil {
+		client.Close()
+		return client, server, serr
+	}
+	if err != nil {
+		server.Close()
+	}
+	return client, server, err
+}